@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"io"
 	"io/ioutil"
+	"sync/atomic"
 )
 
 // uses a chan as a leaky bucket buffer pool
@@ -12,6 +13,11 @@ type bufferPool struct {
 	bufSize int
 	// the actual pool of buffers ready for reuse
 	pool chan *bufferPoolEntry
+	// takes that reused a buffer or had to create one, and gives that
+	// found the pool full
+	hits     int64
+	misses   int64
+	discards int64
 }
 
 // This is what's stored in the buffer.  It allows
@@ -39,6 +45,7 @@ func newBufferPool(poolSize, bufferSize int) *bufferPool {
 func (p *bufferPool) take(r io.Reader) (bpe *bufferPoolEntry) {
 	select {
 	case bpe = <-p.pool:
+		atomic.AddInt64(&p.hits, 1)
 		// prepare for reuse
 		if a := bpe.br.Buffered(); a > 0 {
 			// drain the internal buffer
@@ -48,6 +55,7 @@ func (p *bufferPool) take(r io.Reader) (bpe *bufferPoolEntry) {
 		bpe.source = r
 	default:
 		// none available.  create a new one
+		atomic.AddInt64(&p.misses, 1)
 		bpe = &bufferPoolEntry{nil, r}
 		bpe.br = bufio.NewReaderSize(bpe, p.bufSize)
 	}
@@ -59,5 +67,6 @@ func (p *bufferPool) give(bpe *bufferPoolEntry) {
 	select {
 	case p.pool <- bpe: // return to pool
 	default: // discard
+		atomic.AddInt64(&p.discards, 1)
 	}
 }
@@ -0,0 +1,223 @@
+package falcore
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A set of TLS certificates selected by the SNI server name of each
+// handshake.  Names are taken from the certificates themselves and may
+// be wildcards like *.example.com.  The first key pair added is the
+// default used when the client doesn't send a name or nothing matches.
+//
+// The certificates can be reloaded from disk at any time.  Connections
+// that are already open keep the certificate they were handshaked with
+// so nothing is dropped.
+//
+//    store := falcore.NewCertStore()
+//    store.AddKeyPair("example.com.crt", "example.com.key")
+//    store.AddKeyPair("wildcard.crt", "wildcard.key")
+//    store.ReloadOnSignal(syscall.SIGUSR2)
+//    srv.AddListener(&falcore.Listener{Addr: ":443", TLSConfig: store.TLSConfig()})
+type CertStore struct {
+	files []certFiles
+
+	mu       sync.RWMutex
+	byName   map[string]*tls.Certificate
+	fallback *tls.Certificate
+	modTimes map[string]time.Time
+
+	stop     chan int
+	stopOnce sync.Once
+}
+
+type certFiles struct {
+	certFile string
+	keyFile  string
+}
+
+func NewCertStore() *CertStore {
+	return &CertStore{
+		byName:   make(map[string]*tls.Certificate),
+		modTimes: make(map[string]time.Time),
+		stop:     make(chan int),
+	}
+}
+
+// Loads a key pair and adds it to the store.  It's served for all the
+// DNS names in the certificate.  Not safe to call while serving, use
+// Reload to pick up changes to files already in the store.
+func (cs *CertStore) AddKeyPair(certFile, keyFile string) error {
+	files := append(cs.files, certFiles{certFile, keyFile})
+	if err := cs.load(files); err != nil {
+		return err
+	}
+	cs.files = files
+	return nil
+}
+
+// Reads all the key pairs from disk again.  If any of them fail to load
+// the store is left unchanged and the error is returned.
+func (cs *CertStore) Reload() error {
+	return cs.load(cs.files)
+}
+
+func (cs *CertStore) load(files []certFiles) error {
+	byName := make(map[string]*tls.Certificate)
+	modTimes := make(map[string]time.Time)
+	var fallback *tls.Certificate
+	for _, f := range files {
+		for _, name := range []string{f.certFile, f.keyFile} {
+			fi, err := os.Stat(name)
+			if err != nil {
+				return err
+			}
+			modTimes[name] = fi.ModTime()
+		}
+		cert, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+		if err != nil {
+			return err
+		}
+		if cert.Leaf == nil {
+			if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+				return err
+			}
+		}
+		names := cert.Leaf.DNSNames
+		if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+			names = []string{cert.Leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			// first one wins, same as the order they were added
+			if _, ok := byName[name]; !ok {
+				byName[name] = &cert
+			}
+		}
+		if fallback == nil {
+			fallback = &cert
+		}
+	}
+
+	cs.mu.Lock()
+	cs.byName = byName
+	cs.fallback = fallback
+	cs.modTimes = modTimes
+	cs.mu.Unlock()
+	return nil
+}
+
+// Selects the certificate for a handshake.  Use as tls.Config.GetCertificate.
+func (cs *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name != "" {
+		if cert, ok := cs.byName[name]; ok {
+			return cert, nil
+		}
+		// wildcards only match a single label
+		if i := strings.Index(name, "."); i > 0 {
+			if cert, ok := cs.byName["*"+name[i:]]; ok {
+				return cert, nil
+			}
+		}
+	}
+	if cs.fallback == nil {
+		return nil, errors.New("No certificates in the CertStore")
+	}
+	return cs.fallback, nil
+}
+
+// A tls.Config that serves certificates from the store
+func (cs *CertStore) TLSConfig() *tls.Config {
+	return &tls.Config{
+		Rand:           rand.Reader,
+		Time:           time.Now,
+		GetCertificate: cs.GetCertificate,
+	}
+}
+
+// Reloads the certificates whenever one of sigs is received
+func (cs *CertStore) ReloadOnSignal(sigs ...os.Signal) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, sigs...)
+	go func() {
+		defer signal.Stop(sigChan)
+		for {
+			select {
+			case sig := <-sigChan:
+				Info("Received %v.  Reloading certificates", sig)
+				cs.reload()
+			case <-cs.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Checks the certificate and key files every interval and reloads them
+// when any have changed.  If a reload fails, ie the certificate has been
+// replaced but not the key yet, it's retried on the next check.
+func (cs *CertStore) ReloadOnChange(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if cs.changed() {
+					cs.reload()
+				}
+			case <-cs.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (cs *CertStore) changed() bool {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	for name, modTime := range cs.modTimes {
+		if fi, err := os.Stat(name); err != nil || !fi.ModTime().Equal(modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+func (cs *CertStore) reload() {
+	if err := cs.Reload(); err != nil {
+		Error("Certificate reload failed: %v", err)
+	} else {
+		Info("Reloaded %d certificates", len(cs.files))
+	}
+}
+
+// Stops reloading on signals and file changes
+func (cs *CertStore) Close() {
+	cs.stopOnce.Do(func() { close(cs.stop) })
+}
+
+// Loads PEM encoded CA certificates for verifying client certificates
+func LoadCertPool(files ...string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, errors.New("No certificates found in " + file)
+		}
+	}
+	return pool, nil
+}
@@ -0,0 +1,78 @@
+package falcore
+
+import (
+	"crypto/tls"
+	"os"
+	"testing"
+	"time"
+)
+
+func certName(cert *tls.Certificate) string {
+	return cert.Leaf.Subject.CommonName
+}
+
+func TestCertStore(t *testing.T) {
+	dir := t.TempDir()
+	store := NewCertStore()
+	defer store.Close()
+	for _, names := range [][]string{{"default.com"}, {"example.com", "www.example.com"}, {"*.wild.com"}} {
+		certFile, keyFile := writeTestCert(t, dir, names...)
+		if err := store.AddKeyPair(certFile, keyFile); err != nil {
+			t.Fatalf("Could not add key pair: %v", err)
+		}
+	}
+
+	var tests = []struct {
+		serverName string
+		expected   string
+	}{
+		{"example.com", "example.com"},
+		{"WWW.Example.com.", "example.com"},
+		{"a.wild.com", "*.wild.com"},
+		{"a.b.wild.com", "default.com"},
+		{"wild.com", "default.com"},
+		{"", "default.com"},
+	}
+	for _, test := range tests {
+		cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: test.serverName})
+		if err != nil {
+			t.Errorf("%q: GetCertificate error: %v", test.serverName, err)
+		} else if certName(cert) != test.expected {
+			t.Errorf("%q: got certificate %v expected %v", test.serverName, certName(cert), test.expected)
+		}
+	}
+}
+
+func TestCertStoreReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "example.com")
+	store := NewCertStore()
+	defer store.Close()
+	if err := store.AddKeyPair(certFile, keyFile); err != nil {
+		t.Fatalf("Could not add key pair: %v", err)
+	}
+	hello := &tls.ClientHelloInfo{ServerName: "example.com"}
+	before, _ := store.GetCertificate(hello)
+
+	// a broken key leaves the old certificate in place
+	os.WriteFile(keyFile, []byte("garbage"), 0600)
+	if err := store.Reload(); err == nil {
+		t.Errorf("Expected reload error")
+	}
+	if cert, _ := store.GetCertificate(hello); cert != before {
+		t.Errorf("Certificate changed after failed reload")
+	}
+
+	// rewriting the files is picked up by the watcher
+	store.ReloadOnChange(10 * time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	writeTestCert(t, dir, "example.com")
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if cert, _ := store.GetCertificate(hello); cert.Leaf.SerialNumber.Cmp(before.Leaf.SerialNumber) != 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Certificate not reloaded after files changed")
+}
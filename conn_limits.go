@@ -0,0 +1,119 @@
+package falcore
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Sent to connections over the limits when RejectOverLimit is set or
+// the client has too many connections open
+const overLimitResponse = "HTTP/1.1 503 Service Unavailable\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"Content-Length: 20\r\n" +
+	"Retry-After: 1\r\n" +
+	"Connection: close\r\n" +
+	"\r\n" +
+	"Too many connections"
+
+// Waits for a free connection slot before accepting.  Returns false if
+// the server stopped while waiting.
+func (srv *Server) waitConnSlot() bool {
+	if srv.connSlots == nil || srv.RejectOverLimit {
+		return true
+	}
+	select {
+	case srv.connSlots <- 1:
+		return true
+	default:
+	}
+	// at the limit.  new connections queue up in the listen backlog.
+	atomic.AddInt64(&srv.acceptWaits, 1)
+	select {
+	case srv.connSlots <- 1:
+		return true
+	case <-srv.stopAccepting:
+		return false
+	}
+}
+
+// Takes a slot for a connection that was accepted without waiting.
+// Returns false if there isn't one.
+func (srv *Server) takeConnSlot() bool {
+	if srv.connSlots == nil || !srv.RejectOverLimit {
+		return true
+	}
+	select {
+	case srv.connSlots <- 1:
+		return true
+	default:
+		return false
+	}
+}
+
+func (srv *Server) releaseConnSlot() {
+	if srv.connSlots != nil {
+		<-srv.connSlots
+	}
+}
+
+// Counts a connection against its client's limit.  Returns the client's
+// IP, or "" if the connection doesn't have one, and false if the client
+// already has MaxConnectionsPerIP connections open.
+func (srv *Server) addClientConn(c net.Conn) (string, bool) {
+	var ip string
+	switch a := c.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		ip = a.IP.String()
+	default:
+		return "", true
+	}
+	srv.connMu.Lock()
+	defer srv.connMu.Unlock()
+	if srv.clientConns[ip] >= srv.MaxConnectionsPerIP {
+		return "", false
+	}
+	srv.clientConns[ip]++
+	return ip, true
+}
+
+func (srv *Server) removeClientConn(ip string) {
+	if ip == "" {
+		return
+	}
+	srv.connMu.Lock()
+	defer srv.connMu.Unlock()
+	if srv.clientConns[ip]--; srv.clientConns[ip] <= 0 {
+		delete(srv.clientConns, ip)
+	}
+}
+
+// Answers a connection with a 503 without reading the request.  The
+// caller closes it.
+func (srv *Server) rejectConn(c net.Conn) {
+	atomic.AddInt64(&srv.rejectedConns, 1)
+	Debug("%s %v Rejected connection over the limit", srv.serverLogPrefix(), c.RemoteAddr())
+	c.SetDeadline(time.Now().Add(time.Second))
+	if _, err := io.WriteString(c, overLimitResponse); err != nil {
+		return
+	}
+	lingerClose(c)
+}
+
+// The number of connections being handled
+func (srv *Server) OpenConnections() int64 {
+	return atomic.LoadInt64(&srv.openConns)
+}
+
+// The number of connections answered with a 503 because of the
+// connection limits
+func (srv *Server) RejectedConnections() int64 {
+	return atomic.LoadInt64(&srv.rejectedConns)
+}
+
+// The number of times the accept loop waited for a connection to close
+// because MaxConnections were open
+func (srv *Server) AcceptWaits() int64 {
+	return atomic.LoadInt64(&srv.acceptWaits)
+}
@@ -0,0 +1,155 @@
+package falcore
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func limitTestServer(t *testing.T, configure func(srv *Server)) *Server {
+	p := NewPipeline()
+	p.Upstream.PushBack(NewRequestFilter(okFilter))
+	srv := NewServer(0, p)
+	configure(srv)
+	startTestServer(t, srv)
+	return srv
+}
+
+// Sends a request and returns the status code or an error
+func limitTestRequest(c net.Conn, br *bufio.Reader) (int, error) {
+	if _, err := io.WriteString(c, "GET / HTTP/1.1\r\nHost: test\r\n\r\n"); err != nil {
+		return 0, err
+	}
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	return res.StatusCode, nil
+}
+
+func TestMaxConnectionsWait(t *testing.T) {
+	srv := limitTestServer(t, func(srv *Server) { srv.MaxConnections = 1 })
+	defer srv.Shutdown(context.Background())
+
+	a, abr := testDial(t, srv)
+	if status, err := limitTestRequest(a, abr); status != 200 {
+		t.Fatalf("First connection got %v %v", status, err)
+	}
+
+	// waits in the backlog while a is open
+	b, bbr := testDial(t, srv)
+	defer b.Close()
+	done := make(chan int)
+	go func() {
+		if status, err := limitTestRequest(b, bbr); status != 200 {
+			t.Errorf("Second connection got %v %v", status, err)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatalf("Second connection was served while the first was open")
+	case <-time.After(200 * time.Millisecond):
+	}
+	if n := srv.OpenConnections(); n != 1 {
+		t.Errorf("OpenConnections %v expected 1", n)
+	}
+	if n := srv.AcceptWaits(); n == 0 {
+		t.Errorf("AcceptWaits wasn't counted")
+	}
+
+	a.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Second connection wasn't served after the first closed")
+	}
+}
+
+func TestMaxConnectionsReject(t *testing.T) {
+	srv := limitTestServer(t, func(srv *Server) {
+		srv.MaxConnections = 1
+		srv.RejectOverLimit = true
+	})
+	defer srv.Shutdown(context.Background())
+
+	a, abr := testDial(t, srv)
+	defer a.Close()
+	if status, err := limitTestRequest(a, abr); status != 200 {
+		t.Fatalf("First connection got %v %v", status, err)
+	}
+	b, bbr := testDial(t, srv)
+	defer b.Close()
+	if status, err := limitTestRequest(b, bbr); status != 503 {
+		t.Errorf("Second connection got %v %v expected 503", status, err)
+	}
+	if n := srv.RejectedConnections(); n != 1 {
+		t.Errorf("RejectedConnections %v expected 1", n)
+	}
+}
+
+func TestRejectProxyProtocol(t *testing.T) {
+	_, local, _ := net.ParseCIDR("127.0.0.0/8")
+	srv := limitTestServer(t, func(srv *Server) {
+		srv.Addr = "127.0.0.1:0"
+		srv.ProxyProtocol = &ProxyProtocol{Trusted: []*net.IPNet{local}}
+		srv.MaxConnections = 1
+		srv.RejectOverLimit = true
+	})
+	defer srv.Shutdown(context.Background())
+
+	header := "PROXY TCP4 192.168.0.1 192.168.0.11 56324 80\r\n"
+	a, abr := testDial(t, srv)
+	defer a.Close()
+	io.WriteString(a, header)
+	if status, err := limitTestRequest(a, abr); status != 200 {
+		t.Fatalf("First connection got %v %v", status, err)
+	}
+	b, bbr := testDial(t, srv)
+	defer b.Close()
+	io.WriteString(b, header)
+	if status, err := limitTestRequest(b, bbr); status != 503 {
+		t.Errorf("Second connection got %v %v expected 503", status, err)
+	}
+	// the server shuts its side right after the 503 instead of waiting
+	// for the client to hang up
+	b.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	if _, err := bbr.ReadByte(); err != io.EOF {
+		t.Errorf("Got %v expected EOF after the 503", err)
+	}
+}
+
+func TestMaxConnectionsPerIP(t *testing.T) {
+	srv := limitTestServer(t, func(srv *Server) { srv.MaxConnectionsPerIP = 2 })
+	defer srv.Shutdown(context.Background())
+
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		c, br := testDial(t, srv)
+		defer c.Close()
+		conns = append(conns, c)
+		if status, err := limitTestRequest(c, br); status != 200 {
+			t.Fatalf("Connection %v got %v %v", i, status, err)
+		}
+	}
+	c, br := testDial(t, srv)
+	if status, err := limitTestRequest(c, br); status != 503 {
+		t.Errorf("Third connection got %v %v expected 503", status, err)
+	}
+	c.Close()
+
+	// a slot opens up once a connection closes
+	conns[0].Close()
+	time.Sleep(100 * time.Millisecond)
+	c, br = testDial(t, srv)
+	defer c.Close()
+	if status, err := limitTestRequest(c, br); status != 200 {
+		t.Errorf("Connection after close got %v %v", status, err)
+	}
+}
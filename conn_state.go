@@ -0,0 +1,51 @@
+package falcore
+
+import (
+	"net"
+	"runtime/debug"
+)
+
+// The lifecycle state of a client connection, reported to
+// Server.ConnStateCallback.  A connection starts out new, goes between
+// active and idle for each request and ends up closed.  Hijacked
+// connections are closed once their UpgradeHandler returns.
+type ConnState int
+
+const (
+	// Accepted and waiting for the first request
+	StateNew ConnState = iota
+	// Reading a request, running the pipeline or writing the response.
+	// HTTP/2 connections stay active.
+	StateActive
+	// Waiting for the next request on a keep-alive connection
+	StateIdle
+	// Taken over by an UpgradeHandler
+	StateHijacked
+	// Closed.  This is the last state.
+	StateClosed
+)
+
+var connStateNames = []string{"new", "active", "idle", "hijacked", "closed"}
+
+func (s ConnState) String() string {
+	if s >= 0 && int(s) < len(connStateNames) {
+		return connStateNames[s]
+	}
+	return "unknown"
+}
+
+// Runs the callback from the connection's goroutine so the states of a
+// connection are reported in order.  It should be quick since the
+// connection waits for it.
+func (srv *Server) connStateChanged(c net.Conn, state ConnState) {
+	cb := srv.ConnStateCallback
+	if cb == nil {
+		return
+	}
+	defer func() {
+		if err := recover(); err != nil {
+			Error("%s %v PANIC in ConnStateCallback: %v\n%s", srv.serverLogPrefix(), c.RemoteAddr(), err, debug.Stack())
+		}
+	}()
+	cb(c, state)
+}
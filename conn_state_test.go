@@ -0,0 +1,80 @@
+package falcore
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConnStateCallback(t *testing.T) {
+	var mu sync.Mutex
+	var states []string
+	closed := make(chan int, 1)
+
+	p := NewPipeline()
+	p.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		if req.HttpRequest.Header.Get("Upgrade") == "test" {
+			return NewUpgradeResponse(req, "test", func(c net.Conn, br *bufio.Reader) {})
+		}
+		return SimpleResponse(req.HttpRequest, 200, nil, "OK")
+	}))
+	srv := NewServer(0, p)
+	srv.ConnStateCallback = func(c net.Conn, state ConnState) {
+		mu.Lock()
+		states = append(states, state.String())
+		mu.Unlock()
+		if state == StateClosed {
+			closed <- 1
+		}
+	}
+	startTestServer(t, srv)
+	defer srv.Shutdown(context.Background())
+
+	tests := []struct {
+		requests []string
+		expected string
+	}{
+		{
+			[]string{"GET / HTTP/1.1\r\nHost: test\r\n\r\n", "GET / HTTP/1.1\r\nHost: test\r\n\r\n"},
+			"new active idle active idle closed",
+		},
+		{
+			[]string{"GET / HTTP/1.1\r\nHost: test\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\n"},
+			"new active hijacked closed",
+		},
+	}
+	for _, test := range tests {
+		mu.Lock()
+		states = nil
+		mu.Unlock()
+		c, br := testDial(t, srv)
+		for _, r := range test.requests {
+			io.WriteString(c, r)
+			res, err := http.ReadResponse(br, nil)
+			if err != nil {
+				t.Fatalf("Could not read response: %v", err)
+			}
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+		}
+		// waits for the connection to go idle before hanging up
+		time.Sleep(50 * time.Millisecond)
+		c.Close()
+		select {
+		case <-closed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Connection wasn't closed")
+		}
+		mu.Lock()
+		if got := strings.Join(states, " "); got != test.expected {
+			t.Errorf("Got states %q expected %q", got, test.expected)
+		}
+		mu.Unlock()
+	}
+}
@@ -0,0 +1,147 @@
+package falcore
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Server-Sent Event.  Only Data is required.
+type Event struct {
+	ID    string
+	Event string
+	Data  string
+	// Tells the client how long to wait before reconnecting
+	Retry time.Duration
+}
+
+var errStreamFinished = errors.New("Event stream finished")
+
+// Sends Server-Sent Events (text/event-stream) to a client.  Send can be
+// called from any goroutine.
+type EventStream struct {
+	w           *StreamWriter
+	mu          sync.Mutex
+	lastSend    time.Time
+	lastEventID string
+	finished    bool
+}
+
+// Creates an event stream response.  handler is called once the headers
+// are written and the stream ends when it returns.  It should return
+// when Send fails, req.Ctx() is done or req.Stopping() is closed.
+//
+// A comment is sent as a heartbeat when nothing else has been sent for
+// heartbeat so proxies keep the connection open and a client that's gone
+// is noticed.  Zero disables heartbeats.
+//
+//    return falcore.NewEventStreamResponse(req, 15*time.Second, func(es *falcore.EventStream) {
+//        for {
+//            select {
+//            case msg := <-messages:
+//                if es.Send(&falcore.Event{ID: msg.ID, Data: msg.Text}) != nil {
+//                    return
+//                }
+//            case <-req.Ctx().Done():
+//                return
+//            case <-req.Stopping():
+//                return
+//            }
+//        }
+//    })
+func NewEventStreamResponse(req *Request, heartbeat time.Duration, handler func(es *EventStream)) *http.Response {
+	header := make(http.Header)
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	// nginx buffers responses unless it's told not to
+	header.Set("X-Accel-Buffering", "no")
+	lastEventID := req.HttpRequest.Header.Get("Last-Event-ID")
+	return NewStreamResponse(req, 200, header, func(w *StreamWriter) {
+		es := &EventStream{w: w, lastEventID: lastEventID}
+		// sends the headers right away
+		es.write("")
+		if heartbeat > 0 {
+			done := make(chan int)
+			defer close(done)
+			go es.heartbeats(heartbeat, done)
+		}
+		handler(es)
+		es.mu.Lock()
+		es.finished = true
+		es.mu.Unlock()
+	})
+}
+
+// The ID of the last event the client saw when it reconnected, from the
+// Last-Event-ID header.  Empty on the first connection.
+func (es *EventStream) LastEventID() string {
+	return es.lastEventID
+}
+
+// Sends an event and flushes it to the client
+func (es *EventStream) Send(ev *Event) error {
+	var b strings.Builder
+	if ev.ID != "" {
+		b.WriteString("id: " + oneLine(ev.ID) + "\n")
+	}
+	if ev.Event != "" {
+		b.WriteString("event: " + oneLine(ev.Event) + "\n")
+	}
+	if ev.Retry > 0 {
+		b.WriteString("retry: " + strconv.FormatInt(int64(ev.Retry/time.Millisecond), 10) + "\n")
+	}
+	for _, line := range strings.Split(strings.Replace(ev.Data, "\r\n", "\n", -1), "\n") {
+		b.WriteString("data: " + line + "\n")
+	}
+	b.WriteString("\n")
+	return es.write(b.String())
+}
+
+// Sends a comment, which clients ignore
+func (es *EventStream) Comment(text string) error {
+	var b strings.Builder
+	for _, line := range strings.Split(text, "\n") {
+		b.WriteString(": " + line + "\n")
+	}
+	b.WriteString("\n")
+	return es.write(b.String())
+}
+
+func (es *EventStream) write(s string) error {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if es.finished {
+		return errStreamFinished
+	}
+	es.lastSend = time.Now()
+	if _, err := es.w.Write([]byte(s)); err != nil {
+		return err
+	}
+	return es.w.Flush()
+}
+
+func (es *EventStream) heartbeats(interval time.Duration, done chan int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			es.mu.Lock()
+			idle := time.Since(es.lastSend) >= interval
+			es.mu.Unlock()
+			if idle && es.Comment("heartbeat") != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// Newlines would end the field early
+func oneLine(s string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(s)
+}
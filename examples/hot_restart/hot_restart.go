@@ -1,12 +1,10 @@
 package main
 
 import (
-	"flag"
 	"fmt"
 	"github.com/ngmoco/falcore"
+	"github.com/ngmoco/falcore/restart"
 	"net/http"
-	"os"
-	"os/signal"
 	"syscall"
 )
 
@@ -15,12 +13,8 @@ func Filter(request *falcore.Request) *http.Response {
 	return falcore.SimpleResponse(request.HttpRequest, 200, nil, "OK\n")
 }
 
-// flag to accept a socket file descriptor
-var socketFd = flag.Int("socket", -1, "Socket file descriptor")
-
 func main() {
 	pid := syscall.Getpid()
-	flag.Parse()
 
 	// create the pipeline
 	pipeline := falcore.NewPipeline()
@@ -29,80 +23,25 @@ func main() {
 	// create the server with the pipeline
 	srv := falcore.NewServer(8090, pipeline)
 
-	// if passed the socket file descriptor, setup the listener that way
-	// if you don't have it, the default is to create the socket listener
-	// with the data passed to falcore.NewServer above (happens in ListenAndServer())
-	if *socketFd != -1 {
-		// I know I'm a child process if I get here so I can signal the parent when I'm ready to take over
-		go childReady(srv)
-		fmt.Printf("%v Got socket FD: %v\n", pid, *socketFd)
-		srv.FdListen(*socketFd)
+	// the restart manager passes the listening sockets to the new process.
+	// if this process was started by a restart, the inherited sockets are
+	// used instead of creating new ones.
+	rm := restart.New(srv)
+	if err := rm.Listen(&falcore.Listener{Name: "http", Addr: ":8090"}); err != nil {
+		fmt.Printf("%v Could not listen: %v\n", pid, err)
+		return
+	}
+	if rm.Inherited() {
+		fmt.Printf("%v Took over from the previous process\n", pid)
 	}
 
-	// using signals to manage the restart lifecycle
-	go handleSignals(srv)
+	// SIGHUP restarts, SIGINT and SIGTERM shut down gracefully
+	rm.HandleSignals()
 
 	// start the server
-	// this is normally blocking forever unless you send lifecycle commands 
-	if err := srv.ListenAndServe(); err != nil {
-		fmt.Printf("%v Could not start server: %v", pid, err)
+	// this is blocking until the server is shut down or replaced
+	if err := rm.Serve(); err != nil {
+		fmt.Printf("%v Could not start server: %v\n", pid, err)
 	}
 	fmt.Printf("%v Exiting now\n", pid)
 }
-
-// blocks on the server ready and when ready, it sends 
-// a signal to the parent so that it knows it cna now exit
-func childReady(srv *falcore.Server) {
-	pid := syscall.Getpid()
-	// wait for the ready signal
-	<-srv.AcceptReady
-	// grab the parent and send a signal that the child is ready
-	parent := syscall.Getppid()
-	fmt.Printf("%v Kill parent %v with SIGUSR1\n", pid, parent)
-	syscall.Kill(parent, syscall.SIGUSR1)
-}
-
-// setup and fork/exec myself. Make sure to keep open important FD's that won't get re-created by the child
-// specifically, std* and your listen socket
-func forker(srv *falcore.Server) (pid int, err error) {
-	fmt.Printf("Forking now with socket: %v\n", srv.SocketFd())
-	mypath := os.Args[0]
-	args := []string{mypath, "-socket", fmt.Sprintf("%v", srv.SocketFd())}
-	attr := new(syscall.ProcAttr)
-	attr.Files = append([]uintptr(nil), 0, 1, 2, uintptr(srv.SocketFd()))
-	pid, err = syscall.ForkExec(mypath, args, attr)
-	return
-}
-
-// Handle lifecycle events
-func handleSignals(srv *falcore.Server) {
-	var sig os.Signal
-	var sigChan = make(chan os.Signal)
-	signal.Notify(sigChan, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGINT, syscall.SIGTERM, syscall.SIGTSTP)
-	pid := syscall.Getpid()
-	for {
-		sig = <-sigChan
-		switch sig {
-		case syscall.SIGHUP:
-			// send this to the paraent process to initiate the restart
-			fmt.Println(pid, "Received SIGHUP.  forking.")
-			cpid, err := forker(srv)
-			fmt.Println(pid, "Forked pid:", cpid, "errno:", err)
-		case syscall.SIGUSR1:
-			// child sends this back to the parent when it's ready to Accept
-			fmt.Println(pid, "Received SIGUSR1.  Stopping accept.")
-			srv.StopAccepting()
-		case syscall.SIGINT:
-			fmt.Println(pid, "Received SIGINT.  Shutting down.")
-			os.Exit(0)
-		case syscall.SIGTERM:
-			fmt.Println(pid, "Received SIGTERM.  Terminating.")
-			os.Exit(0)
-		case syscall.SIGTSTP:
-			fmt.Println(pid, "Received SIGTSTP.  Stopping.")
-			syscall.Kill(pid, syscall.SIGSTOP)
-		default:
-			fmt.Println(pid, "Received", sig, ": ignoring")
-		}
-	}
-}
@@ -0,0 +1,74 @@
+package falcore
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var errBodyNotSent = errors.New("Request body wasn't sent without 100 Continue")
+
+// A client that sends Expect: 100-continue waits for a 100 Continue
+// before it sends the body.  It's sent the first time a filter reads the
+// body so a filter that answers first, ie with a 401 or 413, never has
+// the body sent at all.
+type expectContinueReader struct {
+	srv  *Server
+	c    net.Conn
+	body io.ReadCloser
+	mu   sync.Mutex
+	sent bool
+	err  error
+}
+
+// Wraps the body if the client is waiting for 100 Continue.  HTTP/1.0
+// clients can't be sent one so the header is ignored for them.
+func (srv *Server) expectContinue(c net.Conn, req *http.Request) *expectContinueReader {
+	if !req.ProtoAtLeast(1, 1) || req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+	if !headerHasToken(req.Header, "Expect", "100-continue") {
+		return nil
+	}
+	ec := &expectContinueReader{srv: srv, c: c, body: req.Body}
+	req.Body = ec
+	return ec
+}
+
+func (r *expectContinueReader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	if !r.sent {
+		r.sent = true
+		if r.srv.WriteTimeout > 0 {
+			r.c.SetWriteDeadline(time.Now().Add(r.srv.WriteTimeout))
+		}
+		if _, r.err = io.WriteString(r.c, "HTTP/1.1 100 Continue\r\n\r\n"); r.err == nil {
+			// TCP_CORK would hold it back
+			r.srv.cycleNonBlock(r.c)
+		}
+	}
+	err := r.err
+	r.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return r.body.Read(p)
+}
+
+// The body can only be drained if the client was told to send it.
+// Otherwise the error makes the server close the connection.
+func (r *expectContinueReader) Close() error {
+	if !r.continued() {
+		return errBodyNotSent
+	}
+	return r.body.Close()
+}
+
+func (r *expectContinueReader) continued() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sent
+}
@@ -2,6 +2,7 @@ package falcore
 
 import (
 	"net/http"
+	"time"
 )
 
 // Filter incomming requests and optionally return a response or nil.
@@ -55,3 +56,19 @@ type genericResponseFilter struct {
 func (f *genericResponseFilter) FilterResponse(req *Request, res *http.Response) {
 	f.f(req, res)
 }
+
+// Gives the rest of the pipeline a deadline.  The request's context is
+// canceled timeout after the filter runs.  Put it at the start of a
+// route's pipeline to limit how long that route can take.
+func NewDeadlineFilter(timeout time.Duration) RequestFilter {
+	return &deadlineFilter{timeout}
+}
+
+type deadlineFilter struct {
+	timeout time.Duration
+}
+
+func (f *deadlineFilter) FilterRequest(req *Request) *http.Response {
+	req.SetDeadline(time.Now().Add(f.timeout))
+	return nil
+}
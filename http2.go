@@ -0,0 +1,292 @@
+package falcore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HTTP/2 connections are handed off to a net/http Server that does the
+// framing and stream management.  Its handler runs each stream through the
+// same pipeline code as the HTTP/1 connection loop so PipelineStageStats
+// and the RequestDoneCallback behave the same for both protocols.
+type http2Server struct {
+	srv      *Server
+	server   *http.Server
+	listener *connListener
+}
+
+// The start of the HTTP/2 client connection preface.  It's enough to
+// recognize prior knowledge h2c without blocking on short HTTP/1 requests.
+const http2PrefacePrefix = "PRI * HTTP/2.0"
+
+type http2ConnKey struct{}
+
+func newHTTP2Server(srv *Server) *http2Server {
+	h := &http2Server{srv: srv}
+	h.listener = newConnListener(srv.listeners[0].NetAddr())
+	h.server = &http.Server{
+		Handler: h,
+		// ReadHeaderTimeout and ReadTimeout apply per stream for HTTP/2.
+		// WriteTimeout is set on each response once the pipeline is done,
+		// like it is for HTTP/1.
+		ReadHeaderTimeout: srv.headerTimeout(),
+		ReadTimeout:       srv.ReadTimeout,
+		IdleTimeout:       srv.idleTimeout(),
+		ErrorLog:          log.New(&http2ErrorLog{srv}, "", 0),
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, http2ConnKey{}, c)
+		},
+	}
+	h.server.Protocols = new(http.Protocols)
+	h.server.Protocols.SetHTTP2(true)
+	h.server.Protocols.SetUnencryptedHTTP2(srv.EnableH2C)
+	go h.server.Serve(h.listener)
+	return h
+}
+
+// Checks if the new connection speaks HTTP/2 and if so, serves it until
+// it's closed.  Returns true if the connection was handled.
+func (h *http2Server) detect(c net.Conn, br *bufio.Reader) (bool, error) {
+	if tc, ok := c.(*tls.Conn); ok {
+		if err := tc.Handshake(); err != nil {
+			return false, err
+		}
+		if tc.ConnectionState().NegotiatedProtocol != "h2" {
+			return false, nil
+		}
+		h.serve(c, &tlsHTTP2Conn{newHTTP2Conn(c, nil), tc})
+		return true, nil
+	}
+	if !h.srv.EnableH2C {
+		return false, nil
+	}
+	b, err := br.Peek(len(http2PrefacePrefix))
+	if err != nil {
+		return false, err
+	}
+	if string(b) != http2PrefacePrefix {
+		return false, nil
+	}
+	// whatever has been buffered has to be replayed to the http2 server
+	buffered, _ := br.Peek(br.Buffered())
+	h.serve(c, newHTTP2Conn(c, buffered))
+	return true, nil
+}
+
+// Blocks until the http2 server is done with the connection
+func (h *http2Server) serve(c net.Conn, hc http2Conner) {
+	// the http2 server manages its own timeouts
+	h.srv.setConnState(c, StateActive, time.Time{})
+	if h.listener.push(hc) {
+		<-hc.done()
+	}
+	atomic.AddInt64(&h.srv.connRequests, hc.streams())
+}
+
+// Sends GOAWAY to all the HTTP/2 connections and closes them once their
+// streams are finished
+func (h *http2Server) shutdown() {
+	h.server.Shutdown(context.Background())
+}
+
+func (h *http2Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	startTime := time.Now()
+	c, _ := req.Context().Value(http2ConnKey{}).(net.Conn)
+	if hc, ok := c.(http2Conner); ok {
+		hc.addStream()
+	}
+	// like HTTP/1 requests, the context ends when a forced Shutdown
+	// cancels the server's, as well as when the stream does
+	ctx, cancel := context.WithCancel(h.srv.baseCtx)
+	defer cancel()
+	stop := context.AfterFunc(req.Context(), cancel)
+	defer stop()
+	req = req.WithContext(ctx)
+	request, res := h.srv.handleRequest(req, c, startTime)
+	if upgradeHandler(res) != nil {
+		res = SimpleResponse(req, 400, nil, "Upgrade isn't supported over HTTP/2\n")
+	}
+	if err := writeHTTP2Response(w, res, h.srv.WriteTimeout); err != nil {
+		Debug("%s %s HTTP/2 response write error: %v", h.srv.serverLogPrefix(), request.ID, err)
+	}
+	h.srv.finishRequest(request, res)
+}
+
+// Copies a pipeline response to the stream.  Connection specific headers
+// aren't allowed in HTTP/2.  Streams get writeTimeout again on each flush.
+func writeHTTP2Response(w http.ResponseWriter, res *http.Response, writeTimeout time.Duration) error {
+	rc := http.NewResponseController(w)
+	touch := func() {
+		if writeTimeout > 0 {
+			rc.SetWriteDeadline(time.Now().Add(writeTimeout))
+		}
+	}
+	touch()
+	header := w.Header()
+	for k, v := range res.Header {
+		switch k {
+		case "Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade":
+		default:
+			header[k] = v
+		}
+	}
+	if names := trailerNames(res.Trailer); names != "" {
+		header.Set("Trailer", names)
+	}
+	if res.ContentLength >= 0 && bodyAllowedForStatus(res.StatusCode) {
+		header.Set("Content-Length", strconv.FormatInt(res.ContentLength, 10))
+	}
+	w.WriteHeader(res.StatusCode)
+	if res.Body == nil {
+		return nil
+	}
+	var err error
+	if sb := streamResponseBody(res); sb != nil {
+		sb.once.Do(func() {})
+		sw := &StreamWriter{w: w, trailer: res.Trailer, flush: func() error {
+			touch()
+			return rc.Flush()
+		}}
+		sb.stream(sw)
+		err = sw.err
+	} else {
+		_, err = io.Copy(w, res.Body)
+	}
+	// the prefix sends trailers that weren't declared too
+	for k, v := range res.Trailer {
+		header[http.TrailerPrefix+k] = v
+	}
+	return err
+}
+
+func bodyAllowedForStatus(status int) bool {
+	return !((status >= 100 && status < 200) || status == 204 || status == 304)
+}
+
+// A net.Conn given to the http2 server.  It replays anything falcore
+// buffered while detecting the protocol and signals when it's closed.
+type http2Conn struct {
+	net.Conn
+	r         io.Reader
+	closed    chan int
+	closeOnce sync.Once
+	// requests on the connection, for RequestsPerConnection
+	streamCount int64
+}
+
+type http2Conner interface {
+	net.Conn
+	done() <-chan int
+	addStream()
+	streams() int64
+}
+
+func newHTTP2Conn(c net.Conn, buffered []byte) *http2Conn {
+	hc := &http2Conn{Conn: c, r: c, closed: make(chan int)}
+	if len(buffered) > 0 {
+		hc.r = io.MultiReader(bytes.NewReader(append([]byte(nil), buffered...)), c)
+	}
+	return hc
+}
+
+func (hc *http2Conn) Read(b []byte) (int, error) {
+	return hc.r.Read(b)
+}
+
+func (hc *http2Conn) Close() error {
+	err := hc.Conn.Close()
+	hc.closeOnce.Do(func() { close(hc.closed) })
+	return err
+}
+
+// The connection falcore accepted
+func (hc *http2Conn) NetConn() net.Conn {
+	return hc.Conn
+}
+
+func (hc *http2Conn) done() <-chan int {
+	return hc.closed
+}
+
+func (hc *http2Conn) addStream() {
+	atomic.AddInt64(&hc.streamCount, 1)
+}
+
+func (hc *http2Conn) streams() int64 {
+	return atomic.LoadInt64(&hc.streamCount)
+}
+
+// net/http recognizes TLS connections by their ConnectionState method
+type tlsHTTP2Conn struct {
+	*http2Conn
+	tls *tls.Conn
+}
+
+func (hc *tlsHTTP2Conn) ConnectionState() tls.ConnectionState {
+	return hc.tls.ConnectionState()
+}
+
+// A net.Listener that accepts connections handed to it by the server
+type connListener struct {
+	addr      net.Addr
+	conns     chan net.Conn
+	closed    chan int
+	closeOnce sync.Once
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{
+		addr:   addr,
+		conns:  make(chan net.Conn),
+		closed: make(chan int),
+	}
+}
+
+// Returns false if the listener has been closed
+func (l *connListener) push(c net.Conn) bool {
+	select {
+	case l.conns <- c:
+		return true
+	case <-l.closed:
+		return false
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
+
+// Sends the net/http error log to the falcore logger
+type http2ErrorLog struct {
+	srv *Server
+}
+
+func (l *http2ErrorLog) Write(p []byte) (int, error) {
+	Warn("%s SERVER %s", l.srv.serverLogPrefix(), strings.TrimSpace(string(p)))
+	return len(p), nil
+}
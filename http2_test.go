@@ -0,0 +1,237 @@
+package falcore
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writes a self signed certificate for names to dir
+func writeTestCert(t *testing.T, dir string, names ...string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Could not create certificate: %v", err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	certFile = filepath.Join(dir, names[0]+".crt")
+	keyFile = filepath.Join(dir, names[0]+".key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return
+}
+
+func http2TestPipeline(stages chan []string) *Pipeline {
+	p := NewPipeline()
+	p.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		res := SimpleResponse(req.HttpRequest, 200, nil, req.HttpRequest.Proto)
+		res.Trailer = http.Header{"X-Proto": {req.HttpRequest.Proto}}
+		return res
+	}))
+	p.RequestDoneCallback = NewRequestFilter(func(req *Request) *http.Response {
+		var names []string
+		for e := req.PipelineStageStats.Front(); e != nil; e = e.Next() {
+			names = append(names, e.Value.(*PipelineStageStat).Name)
+		}
+		stages <- names
+		return nil
+	})
+	return p
+}
+
+func checkHTTP2Response(t *testing.T, client *http.Client, url string, stages chan []string) {
+	res, err := client.Get(url)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.ProtoMajor != 2 || string(body) != "HTTP/2.0" {
+		t.Errorf("Expected HTTP/2 got %v with body %q", res.Proto, body)
+	}
+	if v := res.Trailer.Get("X-Proto"); v != "HTTP/2.0" {
+		t.Errorf("Trailer %q expected HTTP/2.0", v)
+	}
+	names := <-stages
+	if len(names) != 3 || names[0] != "server.Init" || names[2] != "server.ResponseWrite" {
+		t.Errorf("Unexpected pipeline stages: %v", names)
+	}
+}
+
+func TestHTTP2TLS(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, t.TempDir(), "localhost")
+	stages := make(chan []string, 1)
+	srv := NewServer(0, http2TestPipeline(stages))
+	if err := srv.socketListen(); err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	go srv.ListenAndServeTLS(certFile, keyFile)
+	<-srv.AcceptReady
+	defer srv.Shutdown(context.Background())
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+	checkHTTP2Response(t, client, fmt.Sprintf("https://localhost:%d/", srv.Port()), stages)
+}
+
+func TestHTTP2Cleartext(t *testing.T) {
+	stages := make(chan []string, 1)
+	srv := NewServer(0, http2TestPipeline(stages))
+	srv.EnableH2C = true
+	startTestServer(t, srv)
+	defer srv.Shutdown(context.Background())
+
+	// prior knowledge h2c
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+	checkHTTP2Response(t, client, fmt.Sprintf("http://localhost:%d/", srv.Port()), stages)
+
+	// HTTP/1 still works on the same port
+	res, err := http.Get(fmt.Sprintf("http://localhost:%d/", srv.Port()))
+	if err != nil {
+		t.Fatalf("HTTP/1 request failed: %v", err)
+	}
+	res.Body.Close()
+	<-stages
+	if res.ProtoMajor != 1 {
+		t.Errorf("Expected HTTP/1 got %v", res.Proto)
+	}
+}
+
+func TestHTTP2Timeouts(t *testing.T) {
+	p := NewPipeline()
+	p.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		switch req.HttpRequest.URL.Path {
+		case "/slow":
+			// the pipeline's time doesn't count against WriteTimeout
+			time.Sleep(300 * time.Millisecond)
+		case "/stream":
+			return NewStreamResponse(req, 200, nil, func(w *StreamWriter) {
+				for i := 0; i < 4; i++ {
+					io.WriteString(w, "x")
+					w.Flush()
+					time.Sleep(100 * time.Millisecond)
+				}
+			})
+		case "/stuck":
+			return NewStreamResponse(req, 200, nil, func(w *StreamWriter) {
+				w.Flush()
+				time.Sleep(time.Second)
+			})
+		case "/upload":
+			if _, err := io.ReadAll(req.HttpRequest.Body); err != nil {
+				return SimpleResponse(req.HttpRequest, 408, nil, err.Error())
+			}
+		}
+		return okFilter(req)
+	}))
+	srv := NewServer(0, p)
+	srv.EnableH2C = true
+	srv.ReadTimeout = 200 * time.Millisecond
+	srv.WriteTimeout = 200 * time.Millisecond
+	startTestServer(t, srv)
+	defer srv.Shutdown(context.Background())
+
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}, Timeout: 5 * time.Second}
+	url := fmt.Sprintf("http://localhost:%d", srv.Port())
+	get := func(path string) (string, error) {
+		res, err := client.Get(url + path)
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		return string(body), err
+	}
+
+	if body, err := get("/slow"); body != "OK" || err != nil {
+		t.Errorf("Slow pipeline got %q %v", body, err)
+	}
+	// each flush gets WriteTimeout again
+	if body, err := get("/stream"); body != "xxxx" || err != nil {
+		t.Errorf("Stream got %q %v", body, err)
+	}
+	if _, err := get("/stuck"); err == nil {
+		t.Errorf("Stuck stream wasn't timed out")
+	}
+
+	// a body that stops arriving hits ReadTimeout
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go io.WriteString(pw, "partial")
+	res, err := client.Post(url+"/upload", "text/plain", pr)
+	if err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 408 {
+		t.Errorf("Upload got %v expected 408", res.StatusCode)
+	}
+}
+
+func TestHTTP2ContextCanceled(t *testing.T) {
+	canceled := make(chan error, 1)
+	entered := make(chan int)
+	p := NewPipeline()
+	p.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		close(entered)
+		select {
+		case <-req.Ctx().Done():
+			canceled <- req.Ctx().Err()
+		case <-time.After(5 * time.Second):
+			canceled <- nil
+		}
+		return okFilter(req)
+	}))
+	srv := NewServer(0, p)
+	srv.EnableH2C = true
+	startTestServer(t, srv)
+
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+	go func() {
+		if res, err := client.Get(fmt.Sprintf("http://localhost:%d/", srv.Port())); err == nil {
+			res.Body.Close()
+		}
+	}()
+	<-entered
+
+	// what a forced Shutdown does before closing the connections.  It
+	// has to reach HTTP/2 requests like HTTP/1 ones.
+	srv.cancelBaseCtx()
+	defer srv.Shutdown(context.Background())
+	if err := <-canceled; err != context.Canceled {
+		t.Errorf("Context error %v expected %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,249 @@
+package falcore
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// A socket the Server accepts connections on.  A Server can own any
+// number of listeners (plain, TLS or unix) which all feed the same
+// pipeline and share the buffer pool and shutdown.
+//
+// Set File to listen on an inherited socket, ie for hot restart, instead
+// of creating a new one.  The other fields still describe the listener.
+type Listener struct {
+	// Identifies the listener when its socket is passed to a new process
+	Name string
+	// "tcp" (the default), "tcp4", "tcp6" or "unix"
+	Network string
+	// host:port for tcp or the socket path for unix
+	Addr string
+	// Serve TLS on this listener if set
+	TLSConfig *tls.Config
+	// Permissions and ownership for unix sockets
+	UnixSocket UnixSocketOptions
+	// Read the PROXY protocol header from load balancers if set
+	ProxyProtocol *ProxyProtocol
+	// An inherited socket to use instead of creating one
+	File *os.File
+	// Set SO_REUSEPORT so other sockets can listen on the same port
+	ReusePort bool
+	// Length of the listen queue.  Zero uses the OS default.
+	Backlog int
+
+	// the raw socket and the (possibly TLS) listener connections
+	// are accepted from
+	raw      fileListener
+	listener net.Listener
+	// dup of the socket to pass to a new process.  The fd is saved
+	// because calling file.Fd() puts the socket in blocking mode.
+	file *os.File
+	fd   int
+	// the first of a set from ReusePortListeners.  Its address is used
+	// so a port of 0 gets the same port for the whole set.
+	reuseOf *Listener
+}
+
+// Makes n listeners like l on the same address with SO_REUSEPORT set so
+// connections are accepted by n accept loops.  The kernel spreads new
+// connections across the sockets.  l is the first and the others get
+// "-1", "-2" and so on added to its name so a hot restart can match them
+// up.  Add them all with AddListener, or pass them all to the restart
+// Manager.
+func ReusePortListeners(l *Listener, n int) []*Listener {
+	l.ReusePort = true
+	ls := []*Listener{l}
+	for i := 1; i < n; i++ {
+		c := &Listener{
+			Network:       l.Network,
+			Addr:          l.Addr,
+			TLSConfig:     l.TLSConfig,
+			ProxyProtocol: l.ProxyProtocol,
+			ReusePort:     true,
+			Backlog:       l.Backlog,
+			reuseOf:       l,
+		}
+		if l.Name != "" {
+			c.Name = l.Name + "-" + strconv.Itoa(i)
+		}
+		ls = append(ls, c)
+	}
+	return ls
+}
+
+// Implemented by *net.TCPListener and *net.UnixListener.  The file is
+// used to pass the socket to a new process for hot restart.
+type fileListener interface {
+	net.Listener
+	File() (*os.File, error)
+	SetDeadline(t time.Time) error
+}
+
+// Creates or inherits the socket.  Nothing is accepted until the
+// Server is serving.
+func (l *Listener) open(srv *Server) error {
+	if l.raw != nil {
+		return nil
+	}
+	if l.File != nil {
+		return l.inherit(srv)
+	}
+	if l.Network == "unix" {
+		return l.unixListen(srv)
+	}
+
+	if l.Network == "" {
+		l.Network = "tcp"
+	}
+	if l.reuseOf != nil && l.reuseOf.raw != nil {
+		l.Addr = l.reuseOf.raw.Addr().String()
+	}
+	lc := net.ListenConfig{}
+	if l.ReusePort {
+		lc.Control = reusePortControl
+	}
+	nl, err := lc.Listen(context.Background(), l.Network, l.Addr)
+	if err != nil {
+		return err
+	}
+	tl, ok := nl.(*net.TCPListener)
+	if !ok {
+		nl.Close()
+		return errors.New("Unsupported network " + l.Network)
+	}
+	l.raw = tl
+	// setup listener to be non-blocking if we're not on windows.
+	// this is required for hot restart to work.
+	return srv.setupNonBlockingListener(l)
+}
+
+func (l *Listener) inherit(srv *Server) error {
+	// Fd() has to be called before FileListener sets the socket non-blocking
+	fd := int(l.File.Fd())
+	nl, err := net.FileListener(l.File)
+	if err != nil {
+		return err
+	}
+	switch fl := nl.(type) {
+	case *net.TCPListener:
+		l.Network = "tcp"
+		l.raw = fl
+	case *net.UnixListener:
+		l.Network = "unix"
+		// the socket file belongs to whoever passed us the fd
+		fl.SetUnlinkOnClose(false)
+		l.raw = fl
+	default:
+		nl.Close()
+		return errors.New("Broken listener isn't TCP or unix")
+	}
+	l.file, l.fd = l.File, fd
+	l.Addr = l.raw.Addr().String()
+	return nil
+}
+
+// Wraps the socket for TLS if needed.  Called when the Server starts
+// serving so TLSConfig can be set after the socket is opened.
+func (l *Listener) start(srv *Server) {
+	l.listener = l.raw
+	if tl, ok := l.raw.(*net.TCPListener); ok && (srv.keepAlive != 0 || srv.disableNoDelay) {
+		l.listener = &tcpOptionsListener{tl, srv.keepAlive, srv.disableNoDelay}
+	}
+	if l.ProxyProtocol != nil {
+		// the header comes before the TLS handshake
+		l.listener = &proxyListener{l.listener, l.ProxyProtocol}
+	}
+	if l.TLSConfig != nil {
+		config := l.TLSConfig
+		if len(config.NextProtos) == 0 {
+			config = config.Clone()
+			config.NextProtos = []string{"http/1.1"}
+			if !srv.DisableHTTP2 {
+				config.NextProtos = []string{"h2", "http/1.1"}
+			}
+		}
+		l.listener = tls.NewListener(l.listener, config)
+	}
+}
+
+// Applies the server's TCP options to accepted connections
+type tcpOptionsListener struct {
+	*net.TCPListener
+	keepAlive      time.Duration
+	disableNoDelay bool
+}
+
+func (l *tcpOptionsListener) Accept() (net.Conn, error) {
+	c, err := l.TCPListener.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	if l.keepAlive < 0 {
+		c.SetKeepAlive(false)
+	} else if l.keepAlive > 0 {
+		c.SetKeepAlive(true)
+		c.SetKeepAlivePeriod(l.keepAlive)
+	}
+	if l.disableNoDelay {
+		c.SetNoDelay(false)
+	}
+	return c, nil
+}
+
+// Stops listening.  The socket stays open if it was passed to another
+// process.
+func (l *Listener) close() {
+	if l.raw != nil {
+		l.raw.Close()
+	}
+	// the socket stays open as long as the dup'd file is
+	if l.file != nil {
+		l.file.Close()
+	}
+}
+
+// The file descriptor of the socket for passing to a new process
+func (l *Listener) Fd() int {
+	if l.file == nil {
+		return -1
+	}
+	return l.fd
+}
+
+// The address the listener is bound to or nil if it isn't open
+func (l *Listener) NetAddr() net.Addr {
+	if l.raw == nil {
+		return nil
+	}
+	return l.raw.Addr()
+}
+
+// The TCP port the listener is bound to or 0
+func (l *Listener) Port() int {
+	if a, ok := l.NetAddr().(*net.TCPAddr); ok {
+		return a.Port
+	}
+	return 0
+}
+
+func (l *Listener) String() string {
+	s := l.Network + ":" + l.Addr
+	if l.Name != "" {
+		s = l.Name + "=" + s
+	}
+	if l.ProxyProtocol != nil {
+		s += "(proxy)"
+	}
+	if l.TLSConfig != nil {
+		s += "(tls)"
+	}
+	if fd := l.Fd(); fd >= 0 {
+		s += "#" + strconv.Itoa(fd)
+	}
+	return s
+}
@@ -0,0 +1,101 @@
+package falcore
+
+import (
+	"container/list"
+	"errors"
+)
+
+// A filter or router with a name.  Put one in a pipeline's Upstream or
+// Downstream list in place of the bare filter:
+//
+//    p.Upstream.PushBack(falcore.NewNamedStage("upstream", up))
+//    p.InsertBefore("upstream", "auth", authFilter)
+//
+// The name is used for the stage's PipelineStageStat.Name, and so in the
+// request's Signature, instead of the filter's type.  Nested pipelines
+// keep their own stats so their names aren't used there.
+type NamedStage struct {
+	Name string
+	// A RequestFilter or Router in Upstream, a ResponseFilter in Downstream
+	Filter interface{}
+}
+
+func NewNamedStage(name string, filter interface{}) *NamedStage {
+	return &NamedStage{Name: name, Filter: filter}
+}
+
+// The stage's name, or "" if it isn't named, and its filter
+func stageName(v interface{}) (string, interface{}) {
+	if ns, ok := v.(*NamedStage); ok {
+		return ns.Name, ns.Filter
+	}
+	return "", v
+}
+
+// The list element of the named stage in Upstream or Downstream
+func (p *Pipeline) findStage(name string) (*list.List, *list.Element) {
+	for _, l := range []*list.List{p.Upstream, p.Downstream} {
+		for e := l.Front(); e != nil; e = e.Next() {
+			if n, _ := stageName(e.Value); n == name && n != "" {
+				return l, e
+			}
+		}
+	}
+	return nil, nil
+}
+
+// Returns the filter of the stage with the name or nil if there isn't
+// one.  Only this pipeline's Upstream and Downstream are searched, not
+// nested pipelines.
+func (p *Pipeline) Find(name string) interface{} {
+	if _, e := p.findStage(name); e != nil {
+		_, filter := stageName(e.Value)
+		return filter
+	}
+	return nil
+}
+
+// Adds filter as a stage called newName in front of the stage called
+// name, in the same list.
+func (p *Pipeline) InsertBefore(name, newName string, filter interface{}) error {
+	l, mark, err := p.insertMark(name, newName)
+	if err == nil {
+		l.InsertBefore(NewNamedStage(newName, filter), mark)
+	}
+	return err
+}
+
+// Adds filter as a stage called newName after the stage called name, in
+// the same list.
+func (p *Pipeline) InsertAfter(name, newName string, filter interface{}) error {
+	l, mark, err := p.insertMark(name, newName)
+	if err == nil {
+		l.InsertAfter(NewNamedStage(newName, filter), mark)
+	}
+	return err
+}
+
+func (p *Pipeline) insertMark(name, newName string) (*list.List, *list.Element, error) {
+	if newName == "" {
+		return nil, nil, errors.New("Pipeline stage needs a name")
+	}
+	if _, e := p.findStage(newName); e != nil {
+		return nil, nil, errors.New("Pipeline already has a stage named " + newName)
+	}
+	l, mark := p.findStage(name)
+	if mark == nil {
+		return nil, nil, errors.New("No pipeline stage named " + name)
+	}
+	return l, mark, nil
+}
+
+// Removes the stage with the name and returns its filter, or nil if
+// there isn't one
+func (p *Pipeline) Remove(name string) interface{} {
+	l, e := p.findStage(name)
+	if e == nil {
+		return nil
+	}
+	_, filter := stageName(l.Remove(e))
+	return filter
+}
@@ -0,0 +1,230 @@
+package falcore
+
+import (
+	"errors"
+	"net"
+	"runtime"
+	"time"
+)
+
+// Whether responses are written with sendfile and TCP_CORK/TCP_NOPUSH
+type SendfileMode int
+
+const (
+	// On for linux, freebsd and darwin, which have the socket options
+	SendfileAuto SendfileMode = iota
+	SendfileOn
+	SendfileOff
+)
+
+// Settings for NewServerWithOptions.  Zero values get the same defaults
+// as NewServer.
+type ServerOptions struct {
+	// "tcp" (the default), "tcp4", "tcp6" or "unix"
+	Network string
+	// host:port for tcp or the socket path for unix.  Defaults to ":http"
+	// or ":https".
+	Addr string
+	// Binds to the first address of this network interface, ie "eth0".
+	// Addr is then just the port, ie ":8080".
+	Interface string
+	// Permissions and ownership for unix sockets
+	UnixSocket UnixSocketOptions
+
+	// Number of connection read buffers kept for reuse.  Defaults to 100.
+	BufferPoolSize int
+	// Size of each connection's read buffer.  Defaults to 8192.
+	BufferSize int
+	// Whether responses are written with sendfile and TCP_CORK.  The
+	// default, SendfileAuto, uses them where they're supported and
+	// SendfileOn makes it an error where they aren't.
+	Sendfile SendfileMode
+
+	// TCP keep-alive period for accepted connections.  Zero uses Go's
+	// default (15 seconds) and a negative value turns keep-alives off.
+	KeepAlive time.Duration
+	// Turns TCP_NODELAY off so small writes are held back and combined
+	// (Nagle's algorithm).  Go turns it on by default.
+	DisableNoDelay bool
+	// Sets SO_REUSEPORT so other sockets, in this process or another, can
+	// listen on the same port.  Not supported on windows.
+	ReusePort bool
+	// Opens this many SO_REUSEPORT listeners on Addr, each with its own
+	// accept loop, so accepting is spread across cores.  Implies
+	// ReusePort.  Zero or one is a single listener.
+	Acceptors int
+	// Length of the listen queue.  Zero uses the OS default (somaxconn).
+	Backlog int
+
+	// How often the accept loop wakes up to check if it should stop.
+	// Defaults to 3 seconds.
+	AcceptTimeout time.Duration
+	// How long connections accepted just before the server stops
+	// accepting get to send their request.  Defaults to 3 seconds.
+	StopTimeout time.Duration
+}
+
+// Creates a server from opts.  The options are checked and the interface
+// address is looked up here so mistakes show up before the server is
+// started.  A nil opts is the same as NewServer on ":http".
+func NewServerWithOptions(opts *ServerOptions, pipeline *Pipeline) (*Server, error) {
+	if opts == nil {
+		opts = new(ServerOptions)
+	}
+	addr, err := opts.validate()
+	if err != nil {
+		return nil, err
+	}
+	s := NewServer(0, pipeline)
+	s.Network = opts.Network
+	s.Addr = addr
+	s.UnixSocket = opts.UnixSocket
+
+	poolSize, bufSize := 100, 8192
+	if opts.BufferPoolSize > 0 {
+		poolSize = opts.BufferPoolSize
+	}
+	if opts.BufferSize > 0 {
+		bufSize = opts.BufferSize
+	}
+	s.bufferPool = newBufferPool(poolSize, bufSize)
+
+	if opts.Sendfile == SendfileOff {
+		s.sendfile = false
+	}
+	s.keepAlive = opts.KeepAlive
+	s.disableNoDelay = opts.DisableNoDelay
+	s.reusePort = opts.ReusePort || opts.Acceptors > 1
+	s.acceptors = opts.Acceptors
+	s.backlog = opts.Backlog
+	if opts.AcceptTimeout > 0 {
+		s.acceptTimeout = opts.AcceptTimeout
+	}
+	if opts.StopTimeout > 0 {
+		s.stopTimeout = opts.StopTimeout
+	}
+	return s, nil
+}
+
+// Checks the options and returns the address to listen on
+func (opts *ServerOptions) validate() (string, error) {
+	switch opts.Network {
+	case "", "tcp", "tcp4", "tcp6":
+	case "unix":
+		if opts.Addr == "" {
+			return "", errors.New("Unix socket needs a path in Addr")
+		}
+		if opts.Interface != "" || opts.ReusePort || opts.Acceptors > 1 {
+			return "", errors.New("Interface, ReusePort and Acceptors don't apply to unix sockets")
+		}
+	default:
+		return "", errors.New("Unsupported network " + opts.Network)
+	}
+	switch {
+	case opts.BufferPoolSize < 0:
+		return "", errors.New("BufferPoolSize can't be negative")
+	case opts.BufferSize < 0:
+		return "", errors.New("BufferSize can't be negative")
+	case opts.BufferSize > 0 && opts.BufferSize < 256:
+		return "", errors.New("BufferSize must be at least 256")
+	case opts.Acceptors < 0:
+		return "", errors.New("Acceptors can't be negative")
+	case opts.Backlog < 0:
+		return "", errors.New("Backlog can't be negative")
+	case opts.AcceptTimeout < 0 || opts.StopTimeout < 0:
+		return "", errors.New("AcceptTimeout and StopTimeout can't be negative")
+	case opts.Sendfile == SendfileOn && sockOpts().sendfile == 0:
+		return "", errors.New("Sendfile isn't supported on " + runtime.GOOS)
+	case (opts.ReusePort || opts.Acceptors > 1) && sockOpts().reusePort == 0:
+		return "", errors.New("ReusePort isn't supported on " + runtime.GOOS)
+	}
+	if opts.Network == "unix" || (opts.Addr == "" && opts.Interface == "") {
+		return opts.Addr, nil
+	}
+
+	host, port, err := net.SplitHostPort(opts.Addr)
+	if err != nil {
+		return "", errors.New("Addr needs a port: " + err.Error())
+	}
+	network := opts.Network
+	if network == "" {
+		network = "tcp"
+	}
+	// a number or a service name, ie "http"
+	if _, err := net.LookupPort(network, port); err != nil {
+		return "", errors.New("Bad port in Addr: " + err.Error())
+	}
+	if opts.Interface == "" {
+		return opts.Addr, nil
+	}
+	if host != "" {
+		return "", errors.New("Addr can't have a host when Interface is set")
+	}
+	ip, err := interfaceIP(opts.Interface, opts.Network)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(ip.String(), port), nil
+}
+
+// The first address of the interface that suits network.  IPv4 is
+// preferred for "tcp".  IPv6 link-local addresses are skipped since they
+// need a zone.
+func interfaceIP(name, network string) (net.IP, error) {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var v6 net.IP
+	for _, a := range addrs {
+		ipn, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ip4 := ipn.IP.To4(); ip4 != nil {
+			if network != "tcp6" {
+				return ip4, nil
+			}
+		} else if v6 == nil && !ipn.IP.IsLinkLocalUnicast() && network != "tcp4" {
+			v6 = ipn.IP
+		}
+	}
+	if v6 != nil {
+		return v6, nil
+	}
+	return nil, errors.New("Interface " + name + " has no address for " + network)
+}
+
+// The platform's values for the socket options the server sets.  0 means
+// it isn't supported.
+type platformSockOpts struct {
+	// TCP_CORK or TCP_NOPUSH for sendfile
+	sendfile int
+	// SO_REUSEPORT
+	reusePort int
+}
+
+// openbsd/netbsd don't have TCP_NOPUSH so it's likely sendfile will be slower
+// without these socket options, just enable for linux, mac and freebsd.
+// TODO (Graham) windows has TransmitFile zero-copy mechanism, try to use it
+func sockOpts() platformSockOpts {
+	switch runtime.GOOS {
+	case "linux":
+		return platformSockOpts{
+			sendfile:  0x3, // syscall.TCP_CORK
+			reusePort: 0xf, // syscall.SO_REUSEPORT
+		}
+	case "freebsd", "darwin":
+		return platformSockOpts{
+			sendfile:  0x4,   // syscall.TCP_NOPUSH
+			reusePort: 0x200, // syscall.SO_REUSEPORT
+		}
+	case "openbsd", "netbsd", "dragonfly":
+		return platformSockOpts{reusePort: 0x200}
+	}
+	return platformSockOpts{}
+}
@@ -0,0 +1,134 @@
+package falcore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestServerOptionsValidate(t *testing.T) {
+	tests := []ServerOptions{
+		{Network: "udp"},
+		{Network: "unix"},
+		{Network: "unix", Addr: "/tmp/sock", ReusePort: true},
+		{Network: "unix", Addr: "/tmp/sock", Acceptors: 2},
+		{Acceptors: -1},
+		{BufferSize: 10},
+		{BufferPoolSize: -1},
+		{Backlog: -1},
+		{StopTimeout: -time.Second},
+		{Interface: "lo"},
+		{Addr: "localhost"},
+		{Addr: ":99999"},
+		{Addr: ":no-such-service"},
+		{Network: "tcp4", Addr: "127.0.0.1:-1"},
+		{Interface: "lo", Addr: "127.0.0.1:80"},
+		{Interface: "no-such-interface0", Addr: ":80"},
+	}
+	for _, opts := range tests {
+		if _, err := NewServerWithOptions(&opts, NewPipeline()); err == nil {
+			t.Errorf("%+v wasn't rejected", opts)
+		}
+	}
+}
+
+func TestServerOptions(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("needs the lo interface and SO_REUSEPORT")
+	}
+	p := NewPipeline()
+	p.Upstream.PushBack(NewRequestFilter(okFilter))
+	opts := &ServerOptions{
+		Network:        "tcp4",
+		Addr:           ":0",
+		Interface:      "lo",
+		BufferPoolSize: 2,
+		BufferSize:     1024,
+		Sendfile:       SendfileOff,
+		KeepAlive:      time.Minute,
+		DisableNoDelay: true,
+		ReusePort:      true,
+		Backlog:        16,
+		StopTimeout:    time.Second,
+	}
+	srv, err := NewServerWithOptions(opts, p)
+	if err != nil {
+		t.Fatalf("Options rejected: %v", err)
+	}
+	if srv.Addr != "127.0.0.1:0" {
+		t.Errorf("Addr %v expected the interface address", srv.Addr)
+	}
+	startTestServer(t, srv)
+	defer srv.Shutdown(context.Background())
+
+	// another socket can share the port
+	opts.Addr = fmt.Sprintf("127.0.0.1:%d", srv.Port())
+	opts.Interface = ""
+	other, err := NewServerWithOptions(opts, p)
+	if err != nil {
+		t.Fatalf("Options rejected: %v", err)
+	}
+	if err := other.socketListen(); err != nil {
+		t.Errorf("Could not share the port: %v", err)
+	} else {
+		other.defaultListener.close()
+	}
+
+	res, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/", srv.Port()))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "OK" {
+		t.Errorf("Got %q expected OK", body)
+	}
+	if srv.sendfile {
+		t.Errorf("Sendfile wasn't turned off")
+	}
+}
+
+func TestAcceptors(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("needs SO_REUSEPORT")
+	}
+	p := NewPipeline()
+	p.Upstream.PushBack(NewRequestFilter(okFilter))
+	srv, err := NewServerWithOptions(&ServerOptions{Addr: "127.0.0.1:0", Acceptors: 4}, p)
+	if err != nil {
+		t.Fatalf("Options rejected: %v", err)
+	}
+	startTestServer(t, srv)
+	defer srv.Shutdown(context.Background())
+
+	ls := srv.Listeners()
+	if len(ls) != 4 {
+		t.Fatalf("Got %v listeners expected 4", len(ls))
+	}
+	fds := make(map[int]bool)
+	for _, l := range ls {
+		if l.Port() != srv.Port() {
+			t.Errorf("Listener on port %v expected %v", l.Port(), srv.Port())
+		}
+		fds[l.Fd()] = true
+	}
+	if len(fds) != 4 {
+		t.Errorf("Listeners share sockets: %v", srv.SocketFds())
+	}
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	for i := 0; i < 20; i++ {
+		res, err := client.Get(fmt.Sprintf("http://127.0.0.1:%d/", srv.Port()))
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		res.Body.Close()
+	}
+	if s := srv.Stats(); s.AcceptedConnections != 20 {
+		t.Errorf("Accepted %v connections expected 20", s.AcceptedConnections)
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"log"
 	"net/http"
 	"reflect"
+	"runtime/debug"
+	"sync/atomic"
 )
 
 // Pipelines have an upstream and downstream list of filters.
@@ -20,11 +22,20 @@ import (
 // the FilterRequest method for inspection.  Changes to the request
 // will have no effect and the return value is ignored.
 //
+// A panic in a filter or router is recovered.  It's logged with the
+// request ID and stack, the stage's Status is set to PipelineStageFailed
+// and the response becomes the one from PanicResponse.  The remaining
+// ResponseFilters still run.
 //
+// Filters can be wrapped in a NamedStage so they can be found, removed or
+// have others inserted around them by name.
 type Pipeline struct {
 	Upstream            *list.List
 	Downstream          *list.List
 	RequestDoneCallback RequestFilter
+	// Generates the response when a stage panics.  Defaults to a plain
+	// 500 Internal Server Error.
+	PanicResponse func(req *Request, err interface{}) *http.Response
 }
 
 func NewPipeline() (l *Pipeline) {
@@ -34,6 +45,18 @@ func NewPipeline() (l *Pipeline) {
 	return
 }
 
+// Copies the pipeline so a changed version can be built and swapped in
+// with Server.SwapPipeline or PipelineSlot.Swap.  The lists are copied but
+// the filters in them are shared.
+func (p *Pipeline) Clone() *Pipeline {
+	c := NewPipeline()
+	c.Upstream.PushBackList(p.Upstream)
+	c.Downstream.PushBackList(p.Downstream)
+	c.RequestDoneCallback = p.RequestDoneCallback
+	c.PanicResponse = p.PanicResponse
+	return c
+}
+
 // Pipelines are also RequestFilters... wacky eh?
 // Be careful though because a Pipeline will always returns a
 // response so no Filters after a Pipeline filter will be run.
@@ -43,20 +66,21 @@ func (p *Pipeline) FilterRequest(req *Request) *http.Response {
 
 func (p *Pipeline) execute(req *Request) (res *http.Response) {
 	for e := p.Upstream.Front(); e != nil && res == nil; e = e.Next() {
-		switch filter := e.Value.(type) {
+		name, stage := stageName(e.Value)
+		switch filter := stage.(type) {
 		case Router:
-			t := reflect.TypeOf(filter)
-			req.startPipelineStage(t.String())
-			pipe := filter.SelectPipeline(req)
-			req.finishPipelineStage()
+			var pipe RequestFilter
+			if pipe, res = p.route(req, name, filter); res != nil {
+				break
+			}
 			if pipe != nil {
-				res = p.execFilter(req, pipe)
+				res = p.execFilter(req, "", pipe)
 				if res != nil {
 					break
 				}
 			}
 		case RequestFilter:
-			res = p.execFilter(req, filter)
+			res = p.execFilter(req, name, filter)
 			if res != nil {
 				break
 			}
@@ -75,25 +99,122 @@ func (p *Pipeline) execute(req *Request) (res *http.Response) {
 	return
 }
 
-func (p *Pipeline) execFilter(req *Request, filter RequestFilter) *http.Response {
-	if _, skipTracking := filter.(*Pipeline); !skipTracking {
-		t := reflect.TypeOf(filter)
-		req.startPipelineStage(t.String())
+// Runs the router as its own stage.  res is only set if it panicked.
+func (p *Pipeline) route(req *Request, name string, router Router) (pipe RequestFilter, res *http.Response) {
+	if name == "" {
+		name = reflect.TypeOf(router).String()
+	}
+	req.startPipelineStage(name)
+	defer req.finishPipelineStage()
+	defer p.recoverStage(req, &res)
+	return router.SelectPipeline(req), nil
+}
+
+func (p *Pipeline) execFilter(req *Request, name string, filter RequestFilter) (res *http.Response) {
+	// a nested pipeline recovers its own stages
+	if !isPipeline(filter) {
+		if name == "" {
+			name = reflect.TypeOf(filter).String()
+		}
+		req.startPipelineStage(name)
 		defer req.finishPipelineStage()
+		defer p.recoverStage(req, &res)
 	}
 	return filter.FilterRequest(req)
 }
 
+func (p *Pipeline) filterResponse(req *Request, name string, filter ResponseFilter, res *http.Response) {
+	if name == "" {
+		name = reflect.TypeOf(filter).String()
+	}
+	req.startPipelineStage(name)
+	defer req.finishPipelineStage()
+	var panicRes *http.Response
+	defer func() {
+		if panicRes != nil {
+			if res.Body != nil {
+				res.Body.Close()
+			}
+			*res = *panicRes
+		}
+	}()
+	defer p.recoverStage(req, &panicRes)
+	filter.FilterResponse(req, res)
+}
+
+// Deferred around a stage.  A panic is logged, the stage is marked failed
+// and res is set to the panic response.
+func (p *Pipeline) recoverStage(req *Request, res **http.Response) {
+	err := recover()
+	if err == nil {
+		return
+	}
+	req.CurrentStage.Status = PipelineStageFailed
+	Error("%s PANIC in %s: %v\n%s", req.ID, req.CurrentStage.Name, err, debug.Stack())
+	if p.PanicResponse != nil {
+		*res = p.PanicResponse(req, err)
+	}
+	if *res == nil {
+		*res = SimpleResponse(req.HttpRequest, 500, nil, "Internal Server Error\n")
+	}
+}
+
 func (p *Pipeline) down(req *Request, res *http.Response) {
 	for e := p.Downstream.Front(); e != nil; e = e.Next() {
-		if filter, ok := e.Value.(ResponseFilter); ok {
-			t := reflect.TypeOf(filter)
-			req.startPipelineStage(t.String())
-			filter.FilterResponse(req, res)
-			req.finishPipelineStage()
+		name, stage := stageName(e.Value)
+		if filter, ok := stage.(ResponseFilter); ok {
+			p.filterResponse(req, name, filter, res)
 		} else {
 			// TODO
 			break
 		}
 	}
 }
+
+// A place in a pipeline for a nested pipeline that can be swapped while
+// the server is running, ie on a config reload.  Requests already in the
+// old pipeline finish with it.  An empty slot returns no response so the
+// filters after it run.
+//
+//    auth := falcore.NewPipelineSlot(buildAuth(config))
+//    pipeline.Upstream.PushBack(auth)
+//    ...
+//    auth.Swap(buildAuth(newConfig))
+type PipelineSlot struct {
+	pipeline atomic.Value
+}
+
+func NewPipelineSlot(p *Pipeline) *PipelineSlot {
+	s := new(PipelineSlot)
+	s.pipeline.Store(p)
+	return s
+}
+
+// Puts p in the slot and returns the pipeline that was there.  p must be
+// completely built first and mustn't be changed after it's swapped in.
+func (s *PipelineSlot) Swap(p *Pipeline) *Pipeline {
+	old := s.Pipeline()
+	s.pipeline.Store(p)
+	return old
+}
+
+// The pipeline in the slot or nil
+func (s *PipelineSlot) Pipeline() *Pipeline {
+	p, _ := s.pipeline.Load().(*Pipeline)
+	return p
+}
+
+func (s *PipelineSlot) FilterRequest(req *Request) *http.Response {
+	if p := s.Pipeline(); p != nil {
+		return p.execute(req)
+	}
+	return nil
+}
+
+func isPipeline(filter RequestFilter) bool {
+	switch filter.(type) {
+	case *Pipeline, *PipelineSlot:
+		return true
+	}
+	return false
+}
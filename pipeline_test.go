@@ -3,6 +3,8 @@ package falcore
 import (
 	"bytes"
 	"container/list"
+	"fmt"
+	"io"
 	"net/http"
 	"testing"
 	"time"
@@ -174,3 +176,175 @@ func TestPipelineStatsChecksum(t *testing.T) {
 	//req.Trace()
 
 }
+
+type panicRouter struct{}
+
+func (r *panicRouter) SelectPipeline(req *Request) RequestFilter {
+	panic("router")
+}
+
+func TestPipelinePanic(t *testing.T) {
+	panicFilter := NewRequestFilter(func(req *Request) *http.Response {
+		panic("filter")
+	})
+	panicResponseFilter := NewResponseFilter(func(req *Request, res *http.Response) {
+		panic("response filter")
+	})
+	headerFilter := NewResponseFilter(func(req *Request, res *http.Response) {
+		res.Header.Set("X-After", "ran")
+	})
+	okResponse := NewRequestFilter(func(req *Request) *http.Response {
+		return SimpleResponse(req.HttpRequest, 200, nil, "OK")
+	})
+
+	tests := []struct {
+		name       string
+		upstream   []interface{}
+		downstream []ResponseFilter
+		failed     int
+	}{
+		{"filter", []interface{}{panicFilter, okResponse}, []ResponseFilter{headerFilter}, 1},
+		{"router", []interface{}{new(panicRouter), okResponse}, []ResponseFilter{headerFilter}, 1},
+		{"response filter", []interface{}{okResponse}, []ResponseFilter{panicResponseFilter, headerFilter}, 2},
+	}
+	for _, test := range tests {
+		p := NewPipeline()
+		for _, f := range test.upstream {
+			p.Upstream.PushBack(f)
+		}
+		for _, f := range test.downstream {
+			p.Downstream.PushBack(f)
+		}
+		req := validGetRequest()
+		res := p.execute(req)
+		if res.StatusCode != 500 {
+			t.Errorf("%v: status %v expected 500", test.name, res.StatusCode)
+		}
+		if res.Header.Get("X-After") != "ran" {
+			t.Errorf("%v: response filters after the panic didn't run", test.name)
+		}
+		// the panicking stage is marked
+		i := 0
+		for e := req.PipelineStageStats.Front(); e != nil; e = e.Next() {
+			i++
+			pss := e.Value.(*PipelineStageStat)
+			if failed := pss.Status == PipelineStageFailed; failed != (i == test.failed) {
+				t.Errorf("%v: stage %v %v has status %v", test.name, i, pss.Name, pss.Status)
+			}
+		}
+	}
+}
+
+func TestPipelinePanicResponse(t *testing.T) {
+	p := NewPipeline()
+	p.PanicResponse = func(req *Request, err interface{}) *http.Response {
+		return SimpleResponse(req.HttpRequest, 503, nil, fmt.Sprint(err))
+	}
+	p.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		panic("oops")
+	}))
+	res := p.execute(validGetRequest())
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != 503 || string(body) != "oops" {
+		t.Errorf("Got %v %q expected the custom panic response", res.StatusCode, body)
+	}
+}
+
+func TestPipelineSlot(t *testing.T) {
+	bodyFilter := func(body string) RequestFilter {
+		return NewRequestFilter(func(req *Request) *http.Response {
+			return SimpleResponse(req.HttpRequest, 200, nil, body)
+		})
+	}
+	one := NewPipeline()
+	one.Upstream.PushBack(bodyFilter("one"))
+	slot := NewPipelineSlot(one)
+	p := NewPipeline()
+	p.Upstream.PushBack(slot)
+	p.Upstream.PushBack(bodyFilter("after"))
+
+	two := one.Clone()
+	two.Upstream.PushFront(bodyFilter("two"))
+	if one.Upstream.Len() != 1 {
+		t.Errorf("Clone changed the original")
+	}
+	for _, test := range []struct {
+		pipeline *Pipeline
+		body     string
+	}{
+		{one, "one"},
+		{two, "two"},
+		// an empty slot is skipped
+		{nil, "after"},
+	} {
+		slot.Swap(test.pipeline)
+		req := validGetRequest()
+		res := p.execute(req)
+		body, _ := io.ReadAll(res.Body)
+		if string(body) != test.body {
+			t.Errorf("Got %q expected %q", body, test.body)
+		}
+	}
+	if old := slot.Swap(one); old != nil {
+		t.Errorf("Swap returned %v expected the empty slot", old)
+	}
+}
+
+func TestNamedStages(t *testing.T) {
+	p := NewPipeline()
+	p.Upstream.PushBack(NewNamedStage("upstream", NewRequestFilter(successFilter)))
+	p.Downstream.PushBack(NewNamedStage("headers", NewResponseFilter(sumResponseFilter)))
+
+	if err := p.InsertBefore("upstream", "auth", NewRequestFilter(sumFilter)); err != nil {
+		t.Fatalf("InsertBefore failed: %v", err)
+	}
+	if err := p.InsertBefore("auth", "log", NewRequestFilter(sumFilter)); err != nil {
+		t.Fatalf("InsertBefore failed: %v", err)
+	}
+	if err := p.InsertAfter("headers", "compress", NewResponseFilter(sumResponseFilter)); err != nil {
+		t.Fatalf("InsertAfter failed: %v", err)
+	}
+	if p.InsertAfter("missing", "x", NewRequestFilter(sumFilter)) == nil {
+		t.Errorf("Inserted after a missing stage")
+	}
+	if p.InsertAfter("upstream", "auth", NewRequestFilter(sumFilter)) == nil {
+		t.Errorf("Inserted a duplicate name")
+	}
+	if _, ok := p.Find("auth").(RequestFilter); !ok {
+		t.Errorf("Find didn't return the auth filter")
+	}
+	if p.Find("missing") != nil {
+		t.Errorf("Found a missing stage")
+	}
+	if p.Remove("log") == nil || p.Find("log") != nil {
+		t.Errorf("log wasn't removed")
+	}
+	if p.Remove("log") != nil {
+		t.Errorf("Removed a missing stage")
+	}
+
+	stageTrack = list.New()
+	req := validGetRequest()
+	p.execute(req)
+	req.finishRequest()
+	var names []string
+	for e := req.PipelineStageStats.Front(); e != nil; e = e.Next() {
+		names = append(names, e.Value.(*PipelineStageStat).Name)
+	}
+	if fmt.Sprint(names) != "[auth upstream headers compress]" {
+		t.Errorf("Got stages %v", names)
+	}
+
+	// the names make the signature differ from the same filters unnamed
+	unnamed := NewPipeline()
+	unnamed.Upstream.PushBack(NewRequestFilter(sumFilter))
+	unnamed.Upstream.PushBack(NewRequestFilter(successFilter))
+	unnamed.Downstream.PushBack(NewResponseFilter(sumResponseFilter))
+	unnamed.Downstream.PushBack(NewResponseFilter(sumResponseFilter))
+	other := validGetRequest()
+	unnamed.execute(other)
+	other.finishRequest()
+	if req.Signature() == other.Signature() {
+		t.Errorf("Named and unnamed stages have the same signature %v", req.Signature())
+	}
+}
@@ -0,0 +1,391 @@
+package falcore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Settings for accepting the HAProxy PROXY protocol on a listener.  A
+// load balancer in front of the server sends a header with the real
+// client address at the start of each connection.  Both the text (v1) and
+// binary (v2) headers are understood.
+//
+// Connections from trusted sources must start with a header.  Connections
+// from anywhere else are served as they are, with their own address.
+// Connections without an IP address, ie from a unix socket, are trusted.
+//
+//    _, lb, _ := net.ParseCIDR("10.0.0.0/8")
+//    srv.AddListener(&falcore.Listener{
+//        Addr:          ":8080",
+//        ProxyProtocol: &falcore.ProxyProtocol{Trusted: []*net.IPNet{lb}},
+//    })
+type ProxyProtocol struct {
+	// Networks allowed to send a header.  Required for TCP listeners,
+	// otherwise any client could claim to be anyone.  List 0.0.0.0/0 and
+	// ::/0 if every source really is a proxy.
+	Trusted []*net.IPNet
+	// Maximum time to read the header.  Defaults to 5 seconds.
+	HeaderTimeout time.Duration
+}
+
+// The header sent by the proxy for a connection
+type ProxyHeader struct {
+	// 1 or 2
+	Version int
+	// The original client and the address it connected to.  These are
+	// the connection's own addresses if the proxy didn't know them, ie for
+	// a v1 UNKNOWN or v2 LOCAL header.
+	Source      net.Addr
+	Destination net.Addr
+	// Extra information from a v2 header
+	TLVs []ProxyTLV
+}
+
+// A type-length-value field from a v2 header
+type ProxyTLV struct {
+	Type  byte
+	Value []byte
+}
+
+// v2 TLV types
+const (
+	ProxyTLVALPN      = 0x01
+	ProxyTLVAuthority = 0x02
+	ProxyTLVCRC32C    = 0x03
+	ProxyTLVNoop      = 0x04
+	ProxyTLVUniqueID  = 0x05
+	ProxyTLVSSL       = 0x20
+	ProxyTLVNetNS     = 0x30
+)
+
+// Returns the value of the first TLV of type typ or nil
+func (h *ProxyHeader) TLV(typ byte) []byte {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == typ {
+			return tlv.Value
+		}
+	}
+	return nil
+}
+
+// The host name the client asked for, ie the SNI of a TLS connection
+// terminated by the proxy.  Empty if the proxy didn't send it.
+func (h *ProxyHeader) Authority() string {
+	return string(h.TLV(ProxyTLVAuthority))
+}
+
+// The protocol negotiated by the proxy with ALPN
+func (h *ProxyHeader) ALPN() string {
+	return string(h.TLV(ProxyTLVALPN))
+}
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+func (p *ProxyProtocol) trusted(addr net.Addr) bool {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		return true
+	}
+	for _, n := range p.Trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *ProxyProtocol) headerTimeout() time.Duration {
+	if p.HeaderTimeout > 0 {
+		return p.HeaderTimeout
+	}
+	return 5 * time.Second
+}
+
+// Wraps accepted connections.  The header is read on the connection's
+// first Read or RemoteAddr so a slow client can't hold up the accept loop.
+type proxyListener struct {
+	net.Listener
+	opts *ProxyProtocol
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	pc := &proxyConn{Conn: c, opts: l.opts}
+	if !l.opts.trusted(c.RemoteAddr()) {
+		// served as is
+		pc.once.Do(func() {})
+	}
+	return pc, nil
+}
+
+type proxyConn struct {
+	net.Conn
+	opts   *ProxyProtocol
+	once   sync.Once
+	br     *bufio.Reader
+	header *ProxyHeader
+	err    error
+
+	// the read deadline is restored after the header is read
+	mu           sync.Mutex
+	readDeadline time.Time
+}
+
+func (pc *proxyConn) readHeader() {
+	pc.once.Do(func() {
+		pc.Conn.SetReadDeadline(time.Now().Add(pc.opts.headerTimeout()))
+		pc.br = bufio.NewReaderSize(pc.Conn, 256)
+		pc.header, pc.err = readProxyHeader(pc.br, pc.Conn)
+		// timeouts are left alone so they're reported like any other
+		if _, ok := pc.err.(net.Error); pc.err != nil && !ok {
+			pc.err = errors.New("PROXY protocol: " + pc.err.Error())
+		}
+		pc.mu.Lock()
+		pc.Conn.SetReadDeadline(pc.readDeadline)
+		pc.mu.Unlock()
+	})
+}
+
+func (pc *proxyConn) Read(b []byte) (int, error) {
+	pc.readHeader()
+	if pc.err != nil {
+		return 0, pc.err
+	}
+	if pc.br != nil && pc.br.Buffered() > 0 {
+		return pc.br.Read(b)
+	}
+	return pc.Conn.Read(b)
+}
+
+// Lets sendfile work through the wrapper
+func (pc *proxyConn) ReadFrom(r io.Reader) (int64, error) {
+	if rf, ok := pc.Conn.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(pc.Conn, r)
+}
+
+func (pc *proxyConn) RemoteAddr() net.Addr {
+	pc.readHeader()
+	if pc.header != nil {
+		return pc.header.Source
+	}
+	return pc.Conn.RemoteAddr()
+}
+
+func (pc *proxyConn) LocalAddr() net.Addr {
+	pc.readHeader()
+	if pc.header != nil {
+		return pc.header.Destination
+	}
+	return pc.Conn.LocalAddr()
+}
+
+func (pc *proxyConn) SetDeadline(t time.Time) error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.readDeadline = t
+	return pc.Conn.SetDeadline(t)
+}
+
+func (pc *proxyConn) SetReadDeadline(t time.Time) error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.readDeadline = t
+	return pc.Conn.SetReadDeadline(t)
+}
+
+// The header or nil if the connection came from an untrusted source
+func (pc *proxyConn) proxyHeader() *ProxyHeader {
+	pc.readHeader()
+	return pc.header
+}
+
+// The socket under any TLS or HTTP/2 wrapping
+func (pc *proxyConn) NetConn() net.Conn {
+	return pc.Conn
+}
+
+// Finds the PROXY protocol header of a connection, looking through
+// wrappers like *tls.Conn
+func connProxyHeader(c net.Conn) *ProxyHeader {
+	for c != nil {
+		switch v := c.(type) {
+		case *proxyConn:
+			return v.proxyHeader()
+		case interface{ NetConn() net.Conn }:
+			c = v.NetConn()
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func readProxyHeader(br *bufio.Reader, c net.Conn) (*ProxyHeader, error) {
+	b, err := br.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch b[0] {
+	case 'P':
+		return readProxyHeaderV1(br, c)
+	case '\r':
+		return readProxyHeaderV2(br, c)
+	}
+	return nil, errors.New("missing header")
+}
+
+// PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n
+func readProxyHeaderV1(br *bufio.Reader, c net.Conn) (*ProxyHeader, error) {
+	// the longest header is 107 bytes
+	var line []byte
+	for {
+		b, err := br.ReadSlice('\n')
+		line = append(line, b...)
+		if len(line) > 107 {
+			return nil, errors.New("v1 header too long")
+		}
+		if err == nil {
+			break
+		} else if err != bufio.ErrBufferFull {
+			return nil, err
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("v1 header not terminated by CRLF")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errors.New("invalid v1 header")
+	}
+	h := &ProxyHeader{Version: 1, Source: c.RemoteAddr(), Destination: c.LocalAddr()}
+	switch fields[1] {
+	case "UNKNOWN":
+		return h, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, errors.New("unknown v1 protocol " + fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, errors.New("invalid v1 header")
+	}
+	src, err := parseProxyAddr(fields[1], fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+	dst, err := parseProxyAddr(fields[1], fields[3], fields[5])
+	if err != nil {
+		return nil, err
+	}
+	h.Source, h.Destination = src, dst
+	return h, nil
+}
+
+func parseProxyAddr(proto, ip, port string) (*net.TCPAddr, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil || (proto == "TCP4") != (addr.To4() != nil) {
+		return nil, errors.New("invalid v1 address " + ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, errors.New("invalid v1 port " + port)
+	}
+	return &net.TCPAddr{IP: addr, Port: int(p)}, nil
+}
+
+func readProxyHeaderV2(br *bufio.Reader, c net.Conn) (*ProxyHeader, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(br, fixed); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(fixed[:12], proxyV2Signature) {
+		return nil, errors.New("invalid v2 signature")
+	}
+	if fixed[12]>>4 != 2 {
+		return nil, errors.New("unsupported v2 version")
+	}
+	body := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, err
+	}
+	h := &ProxyHeader{Version: 2, Source: c.RemoteAddr(), Destination: c.LocalAddr()}
+
+	var addrLen int
+	switch cmd := fixed[12] & 0xf; cmd {
+	case 0:
+		// LOCAL, ie a health check from the proxy itself
+		return h, nil
+	case 1:
+		// PROXY
+	default:
+		return nil, errors.New("unknown v2 command")
+	}
+	switch fam := fixed[13]; fam >> 4 {
+	case 1:
+		addrLen = 12
+	case 2:
+		addrLen = 36
+	case 3:
+		addrLen = 216
+	default:
+		// UNSPEC
+		return h, nil
+	}
+	if len(body) < addrLen {
+		return nil, errors.New("v2 address block too short")
+	}
+	switch fixed[13] {
+	case 0x11, 0x21:
+		ipLen := (addrLen - 4) / 2
+		h.Source = &net.TCPAddr{
+			IP:   net.IP(append([]byte(nil), body[:ipLen]...)),
+			Port: int(binary.BigEndian.Uint16(body[2*ipLen:])),
+		}
+		h.Destination = &net.TCPAddr{
+			IP:   net.IP(append([]byte(nil), body[ipLen:2*ipLen]...)),
+			Port: int(binary.BigEndian.Uint16(body[2*ipLen+2:])),
+		}
+	case 0x31:
+		h.Source = &net.UnixAddr{Name: unixPath(body[:108]), Net: "unix"}
+		h.Destination = &net.UnixAddr{Name: unixPath(body[108:216]), Net: "unix"}
+	}
+	// UDP and unix datagram addresses aren't useful to an HTTP server
+
+	tlvs := body[addrLen:]
+	for len(tlvs) > 0 {
+		if len(tlvs) < 3 {
+			return nil, errors.New("truncated v2 TLV")
+		}
+		n := int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < 3+n {
+			return nil, errors.New("truncated v2 TLV")
+		}
+		h.TLVs = append(h.TLVs, ProxyTLV{Type: tlvs[0], Value: tlvs[3 : 3+n]})
+		tlvs = tlvs[3+n:]
+	}
+	return h, nil
+}
+
+func unixPath(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
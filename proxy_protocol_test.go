@@ -0,0 +1,147 @@
+package falcore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func proxyHeaderV2(src, dst *net.TCPAddr, tlvs ...ProxyTLV) []byte {
+	var body bytes.Buffer
+	body.Write(src.IP.To4())
+	body.Write(dst.IP.To4())
+	binary.Write(&body, binary.BigEndian, uint16(src.Port))
+	binary.Write(&body, binary.BigEndian, uint16(dst.Port))
+	for _, tlv := range tlvs {
+		body.WriteByte(tlv.Type)
+		binary.Write(&body, binary.BigEndian, uint16(len(tlv.Value)))
+		body.Write(tlv.Value)
+	}
+	var b bytes.Buffer
+	b.Write(proxyV2Signature)
+	b.WriteByte(0x21) // v2 PROXY
+	b.WriteByte(0x11) // TCP over IPv4
+	binary.Write(&b, binary.BigEndian, uint16(body.Len()))
+	b.Write(body.Bytes())
+	return b.Bytes()
+}
+
+// trusts the test's own connections
+func localProxyProtocol() *ProxyProtocol {
+	_, local, _ := net.ParseCIDR("127.0.0.0/8")
+	return &ProxyProtocol{Trusted: []*net.IPNet{local}}
+}
+
+func startProxyTestServer(t *testing.T, pp *ProxyProtocol) *Server {
+	p := NewPipeline()
+	p.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		body := req.RemoteAddr.String()
+		if h := req.ProxyHeader(); h != nil {
+			body += " " + h.Destination.String() + " " + h.Authority()
+		}
+		return SimpleResponse(req.HttpRequest, 200, nil, body)
+	}))
+	srv := NewServer(0, p)
+	srv.Addr = "127.0.0.1:0"
+	srv.ProxyProtocol = pp
+	startTestServer(t, srv)
+	return srv
+}
+
+func proxyTestRequest(t *testing.T, srv *Server, header []byte) string {
+	c, err := net.Dial("tcp", srv.listeners[0].NetAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write(header)
+	io.WriteString(c, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	defer res.Body.Close()
+	b, _ := io.ReadAll(res.Body)
+	return string(b)
+}
+
+func TestProxyProtocol(t *testing.T) {
+	srv := startProxyTestServer(t, localProxyProtocol())
+	defer srv.Shutdown(context.Background())
+
+	tests := []struct {
+		header   []byte
+		expected string
+	}{
+		{[]byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"), "192.168.0.1:56324 192.168.0.11:443 "},
+		{[]byte("PROXY TCP6 2001:db8::1 2001:db8::2 1000 80\r\n"), "[2001:db8::1]:1000 [2001:db8::2]:80 "},
+		{
+			proxyHeaderV2(
+				&net.TCPAddr{IP: net.IPv4(10, 1, 2, 3), Port: 4000},
+				&net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 443},
+				ProxyTLV{ProxyTLVNoop, []byte{0, 0}},
+				ProxyTLV{ProxyTLVAuthority, []byte("example.com")},
+			),
+			"10.1.2.3:4000 10.0.0.1:443 example.com",
+		},
+	}
+	for _, test := range tests {
+		if res := proxyTestRequest(t, srv, test.header); res != test.expected {
+			t.Errorf("%q got %q expected %q", test.header, res, test.expected)
+		}
+	}
+
+	// a trusted connection has to send a header
+	if res := proxyTestRequest(t, srv, nil); res[:6] != "error:" {
+		t.Errorf("Request without a header got %q", res)
+	}
+	if res := proxyTestRequest(t, srv, []byte("PROXY TCP4 bogus\r\n")); res[:6] != "error:" {
+		t.Errorf("Request with an invalid header got %q", res)
+	}
+}
+
+func TestProxyProtocolUntrusted(t *testing.T) {
+	_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+	srv := startProxyTestServer(t, &ProxyProtocol{Trusted: []*net.IPNet{trusted}})
+	defer srv.Shutdown(context.Background())
+
+	res := proxyTestRequest(t, srv, nil)
+	if host, _, _ := net.SplitHostPort(res); host != "127.0.0.1" {
+		t.Errorf("Untrusted request got %q expected the real address", res)
+	}
+}
+
+func TestProxyProtocolNeedsTrusted(t *testing.T) {
+	srv := NewServer(0, NewPipeline())
+	err := srv.AddListener(&Listener{Addr: "127.0.0.1:0", ProxyProtocol: &ProxyProtocol{}})
+	if err == nil {
+		t.Errorf("PROXY protocol without Trusted networks was allowed")
+	}
+	if len(srv.Listeners()) != 0 {
+		t.Errorf("Rejected listener was added")
+	}
+}
+
+func TestProxyProtocolHeaderTimeout(t *testing.T) {
+	pp := localProxyProtocol()
+	pp.HeaderTimeout = 100 * time.Millisecond
+	srv := startProxyTestServer(t, pp)
+	defer srv.Shutdown(context.Background())
+
+	c, err := net.Dial("tcp", srv.listeners[0].NetAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, "PROXY TCP4 ")
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected the connection to be closed, got %v", err)
+	}
+}
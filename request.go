@@ -2,6 +2,9 @@ package falcore
 
 import (
 	"container/list"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"hash"
 	"hash/crc32"
@@ -17,7 +20,10 @@ import (
 // The request is wrapped so that useful information can be kept
 // with the request as it moves through the pipeline.
 //
-// A pointer is kept to the originating Connection.
+// A pointer is kept to the originating Connection.  RemoteNetAddr is
+// the client address for any kind of connection.  RemoteAddr is the
+// same address but is only set for TCP connections.  On listeners that
+// accept the PROXY protocol they're the address of the real client.
 //
 // There is a unique ID assigned to each request.  This ID is not
 // globally unique to keep it shorter for logging purposes.  It is
@@ -44,12 +50,17 @@ type Request struct {
 	HttpRequest        *http.Request
 	Connection         net.Conn
 	RemoteAddr         *net.TCPAddr
+	RemoteNetAddr      net.Addr
 	PipelineStageStats *list.List
 	CurrentStage       *PipelineStageStat
 	pipelineHash       hash.Hash32
 	piplineTot         time.Duration
 	Overhead           time.Duration
 	Context            map[string]interface{}
+	cancel             context.CancelFunc
+	stopping           chan int
+	// the pipeline the server ran the request through
+	pipeline *Pipeline
 }
 
 // Used internally to create and initialize a new request.
@@ -60,7 +71,9 @@ func newRequest(request *http.Request, conn net.Conn, startTime time.Time) *Requ
 	fReq.StartTime = startTime
 	fReq.Connection = conn
 	if conn != nil {
-		fReq.RemoteAddr = conn.RemoteAddr().(*net.TCPAddr)
+		// RemoteAddr is only set for TCP connections
+		fReq.RemoteNetAddr = conn.RemoteAddr()
+		fReq.RemoteAddr, _ = fReq.RemoteNetAddr.(*net.TCPAddr)
 	}
 	// create a semi-unique id to track a connection in the logs
 	// ID is the least significant decimal digits of time with some randomization
@@ -74,7 +87,8 @@ func newRequest(request *http.Request, conn net.Conn, startTime time.Time) *Requ
 
 // Returns a completed falcore.Request and response after running the single filter stage
 // The PipelineStageStats is completed in the returned Request
-// The falcore.Request.Connection and falcore.Request.RemoteAddr are nil
+// The falcore.Request.Connection, falcore.Request.RemoteAddr and
+// falcore.Request.RemoteNetAddr are nil
 func TestWithRequest(request *http.Request, filter RequestFilter, context map[string]interface{}) (*Request, *http.Response) {
 	r := newRequest(request, nil, time.Now())
 	if context == nil {
@@ -89,6 +103,96 @@ func TestWithRequest(request *http.Request, filter RequestFilter, context map[st
 	return r, res
 }
 
+// The context.Context of the request, the same as HttpRequest.Context().
+// It's canceled when the client hangs up, the server is forced to shut
+// down, a deadline set with SetDeadline passes or the request is done.
+// Filters doing slow work should give up when it's done.  (Context is
+// already the map filters use to share values.)
+func (fReq *Request) Ctx() context.Context {
+	if fReq.HttpRequest == nil {
+		return context.Background()
+	}
+	return fReq.HttpRequest.Context()
+}
+
+// The request's trailer fields.  They're only filled in once the body
+// has been read to the end.  Names the client declared are there before
+// that with no values.
+func (fReq *Request) Trailer() http.Header {
+	if fReq.HttpRequest == nil {
+		return nil
+	}
+	return fReq.HttpRequest.Trailer
+}
+
+// Closed when the server starts shutting down.  Long running responses,
+// like an UpgradeHandler or an event stream, should wrap up when it is.
+// It's nil, which blocks forever, outside of a Server.
+func (fReq *Request) Stopping() <-chan int {
+	return fReq.stopping
+}
+
+// Cancels the request's context at t.  HttpRequest is replaced with a
+// copy that has the new context.
+func (fReq *Request) SetDeadline(t time.Time) {
+	if fReq.HttpRequest == nil {
+		return
+	}
+	ctx, cancel := context.WithDeadline(fReq.Ctx(), t)
+	if prev := fReq.cancel; prev != nil {
+		fReq.cancel = func() {
+			cancel()
+			prev()
+		}
+	} else {
+		fReq.cancel = cancel
+	}
+	fReq.HttpRequest = fReq.HttpRequest.WithContext(ctx)
+}
+
+// The TLS connection state or nil if the request didn't come over TLS
+func (fReq *Request) TLS() *tls.ConnectionState {
+	if fReq.HttpRequest == nil {
+		return nil
+	}
+	return fReq.HttpRequest.TLS
+}
+
+// The client certificate chain that was verified against the server's
+// ClientCAs, starting with the client's certificate.  nil if the client
+// didn't send a certificate or it wasn't verified.
+func (fReq *Request) VerifiedPeerChain() []*x509.Certificate {
+	if cs := fReq.TLS(); cs != nil && len(cs.VerifiedChains) > 0 {
+		return cs.VerifiedChains[0]
+	}
+	return nil
+}
+
+// The verified client certificate or nil.  Filters can use its Subject
+// to authorize the request.
+func (fReq *Request) ClientCertificate() *x509.Certificate {
+	if chain := fReq.VerifiedPeerChain(); len(chain) > 0 {
+		return chain[0]
+	}
+	return nil
+}
+
+// The application protocol negotiated with ALPN, ie "h2"
+func (fReq *Request) NegotiatedProtocol() string {
+	if cs := fReq.TLS(); cs != nil {
+		return cs.NegotiatedProtocol
+	}
+	return ""
+}
+
+// The name of the TLS cipher suite or "" if the request isn't over TLS
+func (fReq *Request) CipherSuite() string {
+	if cs := fReq.TLS(); cs != nil {
+		return tls.CipherSuiteName(cs.CipherSuite)
+	}
+	return ""
+}
+
 // Starts a new pipeline stage and makes it the CurrentStage.
 func (fReq *Request) startPipelineStage(name string) {
 	fReq.CurrentStage = NewPiplineStage(name)
@@ -143,12 +247,16 @@ func (fReq *Request) Trace() {
 }
 
 func (fReq *Request) finishRequest() {
+	if fReq.cancel != nil {
+		fReq.cancel()
+	}
 	fReq.EndTime = time.Now()
 	fReq.Overhead = fReq.EndTime.Sub(fReq.StartTime) - fReq.piplineTot
 }
 
 // Container for keeping stats per pipeline stage
-// Name for filter stages is reflect.TypeOf(filter).String()[1:] and the Status is 0 unless
+// Name for filter stages is the NamedStage name if the filter has one,
+// otherwise reflect.TypeOf(filter).String().  The Status is 0 unless
 // it is changed explicitly in the Filter or Router.
 //
 // For the Status, the falcore library will not apply any specific meaning to the status
@@ -168,9 +276,20 @@ type PipelineStageStat struct {
 	EndTime   time.Time
 }
 
+// The Status falcore sets on a stage that panicked.  It's the
+// conventional Fail status.
+const PipelineStageFailed byte = 2
+
 func NewPiplineStage(name string) *PipelineStageStat {
 	pss := new(PipelineStageStat)
 	pss.Name = name
 	pss.StartTime = time.Now()
 	return pss
 }
+
+// The PROXY protocol header sent by the load balancer or nil if the
+// listener doesn't accept the protocol or the connection didn't come from
+// a trusted proxy
+func (fReq *Request) ProxyHeader() *ProxyHeader {
+	return connProxyHeader(fReq.Connection)
+}
@@ -0,0 +1,379 @@
+// +build !windows
+
+// Package restart replaces a running falcore server with a new copy of
+// the program without dropping connections.
+//
+// The new process is started with all of the server's listening sockets
+// and a pipe it uses to report that it's accepting.  Once it's ready the
+// old process stops accepting and drains its connections with a graceful
+// Shutdown.  If the new process exits or doesn't become ready in time it's
+// killed and the old process carries on serving as if nothing happened.
+//
+//    srv := falcore.NewServer(8080, pipeline)
+//    rm := restart.New(srv)
+//    if err := rm.Listen(&falcore.Listener{Name: "http", Addr: ":8080"}); err != nil {
+//        ...
+//    }
+//    rm.HandleSignals()
+//    rm.Serve()
+//
+// Sending SIGHUP to the process restarts it and SIGTERM or SIGINT shut it
+// down gracefully.
+//
+// Under systemd, the first process uses the sockets from socket activation
+// if there are any, matched to listeners by name.  The new process is
+// reported to systemd as the main pid once it's ready.
+package restart
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ngmoco/falcore"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Environment variables used to pass the sockets to the new process
+const (
+	envPid     = "FALCORE_RESTART_PID"
+	envNames   = "FALCORE_RESTART_NAMES"
+	envReadyFd = "FALCORE_RESTART_READY_FD"
+)
+
+// The first fd passed to the new process.  0-2 are stdin, stdout and stderr.
+const firstFd = 3
+
+type Manager struct {
+	Server *falcore.Server
+	// How long the new process has to become ready.  Defaults to 10 seconds.
+	ReadyTimeout time.Duration
+	// How long the old process waits for its requests to finish before
+	// closing the remaining connections.  Defaults to 30 seconds.
+	ShutdownTimeout time.Duration
+	// Optional check run once the server is accepting.  The new process
+	// only reports that it's ready if this returns nil.
+	ReadyCheck func() error
+	// The program and arguments to start.  Defaults to the running
+	// executable and os.Args.
+	Path string
+	Args []string
+
+	inherited map[string]*os.File
+	readyFile *os.File
+	listeners []*falcore.Listener
+
+	mu         sync.Mutex
+	restarting bool
+}
+
+// Creates a Manager for srv and picks up any sockets passed from a
+// previous process
+func New(srv *falcore.Server) *Manager {
+	m := &Manager{
+		Server:          srv,
+		ReadyTimeout:    10 * time.Second,
+		ShutdownTimeout: 30 * time.Second,
+		inherited:       make(map[string]*os.File),
+	}
+	m.inherit()
+	return m
+}
+
+// True if this process was started by a restart
+func (m *Manager) Inherited() bool {
+	return m.readyFile != nil
+}
+
+func (m *Manager) inherit() {
+	pid, _ := strconv.Atoi(os.Getenv(envPid))
+	names := os.Getenv(envNames)
+	readyFd, err := strconv.Atoi(os.Getenv(envReadyFd))
+	os.Unsetenv(envPid)
+	os.Unsetenv(envNames)
+	os.Unsetenv(envReadyFd)
+	// the variables could have leaked from an unrelated parent
+	if pid != os.Getppid() || err != nil {
+		m.systemdInherit()
+		return
+	}
+	if names != "" {
+		for i, name := range strings.Split(names, ",") {
+			fd := firstFd + i
+			syscall.CloseOnExec(fd)
+			m.inherited[name] = os.NewFile(uintptr(fd), name)
+		}
+	}
+	syscall.CloseOnExec(readyFd)
+	m.readyFile = os.NewFile(uintptr(readyFd), "ready")
+}
+
+// The first process started by systemd socket activation uses the
+// sockets it was passed, matched by FileDescriptorName=
+func (m *Manager) systemdInherit() {
+	listeners, err := falcore.SystemdListeners()
+	if err != nil {
+		falcore.Error("Ignoring systemd sockets: %v", err)
+		return
+	}
+	for _, l := range listeners {
+		m.inherited[l.Name] = l.File
+	}
+}
+
+// Adds the listeners to the server, using the inherited socket for each
+// one that was passed from the previous process.  Listeners are matched by
+// Name or by their position if they don't have one.  With no arguments
+// the server's default listeners are used.
+func (m *Manager) Listen(listeners ...*falcore.Listener) error {
+	srv := m.Server
+	if len(listeners) == 0 {
+		listeners = srv.DefaultListeners()
+		for _, l := range listeners {
+			if l.Addr == "" && l.Network != "unix" {
+				l.Addr = ":http"
+			}
+		}
+	}
+	for i, l := range listeners {
+		key := listenerKey(i, l)
+		if f, ok := m.inherited[key]; ok {
+			l.File = f
+			delete(m.inherited, key)
+		}
+		if err := srv.AddListener(l); err != nil {
+			return err
+		}
+		m.listeners = append(m.listeners, l)
+	}
+	// sockets the new configuration doesn't have a listener for
+	for name, f := range m.inherited {
+		falcore.Warn("Closing inherited socket %v with no listener", name)
+		f.Close()
+	}
+	m.inherited = nil
+	return nil
+}
+
+func listenerKey(i int, l *falcore.Listener) string {
+	if l.Name != "" {
+		return l.Name
+	}
+	return strconv.Itoa(i)
+}
+
+// Serves until the server is shut down.  If this process was started by a
+// restart, the old process is told it's ready once the server is accepting
+// and ReadyCheck passes.  Reads the server's AcceptReady channel.
+func (m *Manager) Serve() error {
+	if len(m.listeners) == 0 {
+		if err := m.Listen(); err != nil {
+			return err
+		}
+	}
+	go func() {
+		<-m.Server.AcceptReady
+		if m.readyFile == nil {
+			return
+		}
+		if m.ReadyCheck != nil {
+			if err := m.ReadyCheck(); err != nil {
+				// closing the pipe without writing tells the old process to roll back
+				falcore.Error("Restart ready check failed: %v", err)
+				m.readyFile.Close()
+				// the old process keeps the service so systemd mustn't
+				// hear this one is stopping
+				m.Server.HandOff()
+				m.shutdown()
+				return
+			}
+		}
+		m.readyFile.Write([]byte{1})
+		m.readyFile.Close()
+	}()
+	return m.Server.Serve()
+}
+
+// Starts a new process with the server's sockets and waits for it to
+// become ready.  When it is, the server is shut down gracefully and the
+// result of the shutdown is returned.  Otherwise the new process is
+// killed, this one keeps serving and the error is returned.
+func (m *Manager) Restart() error {
+	m.mu.Lock()
+	if m.restarting {
+		m.mu.Unlock()
+		return errors.New("Restart already in progress")
+	}
+	m.restarting = true
+	m.mu.Unlock()
+
+	cmd, ready, err := m.start()
+	if err != nil {
+		m.rollback()
+		return err
+	}
+	pid := cmd.Process.Pid
+	falcore.Info("Restart started pid %v, waiting for it to be ready", pid)
+
+	result := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1)
+		n, err := ready.Read(b)
+		if n == 0 && err == nil {
+			err = errors.New("No ready signal")
+		}
+		result <- err
+	}()
+	timer := time.NewTimer(m.ReadyTimeout)
+	defer timer.Stop()
+	select {
+	case err = <-result:
+		if err != nil {
+			err = fmt.Errorf("Restarted pid %v didn't become ready: %v", pid, err)
+		}
+	case <-timer.C:
+		err = fmt.Errorf("Restarted pid %v wasn't ready after %v", pid, m.ReadyTimeout)
+	}
+	ready.Close()
+
+	if err != nil {
+		falcore.Error("%v.  Rolling back", err)
+		cmd.Process.Kill()
+		cmd.Wait()
+		m.rollback()
+		return err
+	}
+
+	// the new process is on its own now.  restarting stays set so this
+	// one can't be restarted again while it drains.
+	go cmd.Wait()
+	falcore.Info("Restarted pid %v is ready.  Shutting down", pid)
+	// systemd tracks the new process from now on.  Draining mustn't
+	// look like the service stopping.
+	m.Server.HandOff()
+	if err := falcore.SystemdNotify(fmt.Sprintf("MAINPID=%d", pid)); err != nil {
+		falcore.Warn("systemd notify failed: %v", err)
+	}
+	return m.shutdown()
+}
+
+func (m *Manager) rollback() {
+	m.mu.Lock()
+	m.restarting = false
+	m.mu.Unlock()
+}
+
+// Starts the new process.  Returns the read end of its ready pipe.
+func (m *Manager) start() (*exec.Cmd, *os.File, error) {
+	path := m.Path
+	if path == "" {
+		var err error
+		if path, err = os.Executable(); err != nil {
+			return nil, nil, err
+		}
+	}
+	args := m.Args
+	if args == nil {
+		args = os.Args[1:]
+	}
+
+	var files []*os.File
+	defer func() {
+		// the new process has its own copies
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	names := make([]string, len(m.listeners))
+	for i, l := range m.listeners {
+		names[i] = listenerKey(i, l)
+		if strings.Contains(names[i], ",") {
+			return nil, nil, errors.New("Listener names can't contain a comma: " + names[i])
+		}
+		f, err := dupFile(l.Fd(), names[i])
+		if err != nil {
+			return nil, nil, err
+		}
+		files = append(files, f)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	files = append(files, w)
+
+	env := []string{
+		envPid + "=" + strconv.Itoa(os.Getpid()),
+		envNames + "=" + strings.Join(names, ","),
+		envReadyFd + "=" + strconv.Itoa(firstFd+len(names)),
+	}
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, "FALCORE_RESTART_") {
+			env = append(env, v)
+		}
+	}
+
+	cmd := exec.Command(path, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = env
+	if err = cmd.Start(); err != nil {
+		r.Close()
+		return nil, nil, err
+	}
+	return cmd, r, nil
+}
+
+// Copies a listener's socket.  Its own file can't be passed because
+// calling Fd() on it would put the socket in blocking mode.
+func dupFile(fd int, name string) (*os.File, error) {
+	if fd < 0 {
+		return nil, errors.New("Listener has no socket to pass: " + name)
+	}
+	syscall.ForkLock.RLock()
+	defer syscall.ForkLock.RUnlock()
+	nfd, err := syscall.Dup(fd)
+	if err != nil {
+		return nil, err
+	}
+	syscall.CloseOnExec(nfd)
+	return os.NewFile(uintptr(nfd), name), nil
+}
+
+func (m *Manager) shutdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), m.ShutdownTimeout)
+	defer cancel()
+	return m.Server.Shutdown(ctx)
+}
+
+// Restarts on SIGHUP and shuts down gracefully on SIGTERM or SIGINT
+func (m *Manager) HandleSignals() {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		for sig := range sigChan {
+			switch sig {
+			case syscall.SIGHUP:
+				falcore.Info("Received %v.  Restarting", sig)
+				if err := m.Restart(); err != nil {
+					falcore.Error("Restart failed: %v", err)
+				}
+			default:
+				falcore.Info("Received %v.  Shutting down", sig)
+				signal.Stop(sigChan)
+				if err := m.shutdown(); err != nil {
+					falcore.Error("Shutdown: %v", err)
+				}
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,293 @@
+// +build linux
+
+package restart
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/ngmoco/falcore"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// The test binary runs itself as the server so a real restart can be done
+func TestMain(m *testing.M) {
+	if os.Getenv("RESTART_TEST_SERVER") != "" {
+		testServer()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// Serves the pid on a random port with two SO_REUSEPORT listeners and
+// prints the port and status lines.
+// Restarted copies fail to become ready if RESTART_TEST_FAIL is set.
+func testServer() {
+	pipeline := falcore.NewPipeline()
+	pipeline.Upstream.PushBack(falcore.NewRequestFilter(func(req *falcore.Request) *http.Response {
+		return falcore.SimpleResponse(req.HttpRequest, 200, nil, strconv.Itoa(os.Getpid()))
+	}))
+	srv := falcore.NewServer(0, pipeline)
+	rm := New(srv)
+	rm.ReadyTimeout = 5 * time.Second
+	rm.ShutdownTimeout = 5 * time.Second
+	if rm.Inherited() && os.Getenv("RESTART_TEST_FAIL") != "" {
+		rm.ReadyCheck = func() error { return fmt.Errorf("Failing on purpose") }
+	}
+	listeners := falcore.ReusePortListeners(&falcore.Listener{Name: "http", Addr: "127.0.0.1:0"}, 2)
+	if err := rm.Listen(listeners...); err != nil {
+		fmt.Println("listen error", err)
+		os.Exit(1)
+	}
+	// the test signals as soon as it sees the status line
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP, syscall.SIGTERM)
+	go func() {
+		for sig := range sigChan {
+			if sig == syscall.SIGHUP {
+				if err := rm.Restart(); err != nil {
+					fmt.Println("restart failed")
+				}
+			} else {
+				rm.shutdown()
+			}
+		}
+	}()
+	if !rm.Inherited() {
+		fmt.Println("port", srv.Port())
+	} else {
+		inherited := 0
+		for _, l := range listeners {
+			if l.File != nil {
+				inherited++
+			}
+		}
+		fmt.Println("inherited", inherited)
+	}
+	rm.Serve()
+	fmt.Println("exit", os.Getpid())
+}
+
+type testProcess struct {
+	cmd   *exec.Cmd
+	lines chan string
+	url   string
+}
+
+func startTestProcess(t *testing.T, env ...string) *testProcess {
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(), append(env, "RESTART_TEST_SERVER=1")...)
+	cmd.Stderr = os.Stderr
+	// restarted copies inherit stdout so it can't be closed when the
+	// first process exits
+	out, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd.Stdout = w
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testProcess{cmd: cmd, lines: make(chan string, 100)}
+	go func() {
+		s := bufio.NewScanner(out)
+		for s.Scan() {
+			p.lines <- s.Text()
+		}
+		close(p.lines)
+		out.Close()
+	}()
+	line := p.waitFor(t, "port ")
+	p.url = "http://127.0.0.1:" + strings.TrimPrefix(line, "port ") + "/"
+	return p
+}
+
+func (p *testProcess) waitFor(t *testing.T, prefix string) string {
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case line, ok := <-p.lines:
+			if !ok {
+				t.Fatalf("Server exited waiting for %q", prefix)
+			}
+			if strings.HasPrefix(line, prefix) {
+				return line
+			}
+		case <-timeout:
+			t.Fatalf("Timed out waiting for %q", prefix)
+		}
+	}
+}
+
+// Returns the pid of the process that served the request
+func (p *testProcess) get(t *testing.T) int {
+	res, err := http.Get(p.url)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer res.Body.Close()
+	b, _ := io.ReadAll(res.Body)
+	pid, _ := strconv.Atoi(string(b))
+	return pid
+}
+
+func TestRestart(t *testing.T) {
+	p := startTestProcess(t)
+	defer p.cmd.Process.Kill()
+	parent := p.get(t)
+
+	// keep requests going through the restart
+	stop := make(chan int)
+	errs := make(chan error, 1)
+	go func() {
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+		for {
+			select {
+			case <-stop:
+				errs <- nil
+				return
+			default:
+			}
+			res, err := client.Get(p.url)
+			if err != nil {
+				errs <- err
+				return
+			}
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+		}
+	}()
+
+	p.cmd.Process.Signal(syscall.SIGHUP)
+	// both sockets are passed on
+	if line := p.waitFor(t, "inherited "); line != "inherited 2" {
+		t.Errorf("Got %q expected both listeners inherited", line)
+	}
+	p.waitFor(t, fmt.Sprintf("exit %v", parent))
+	p.cmd.Wait()
+	close(stop)
+	if err := <-errs; err != nil {
+		t.Errorf("Request failed during restart: %v", err)
+	}
+
+	child := p.get(t)
+	if child == parent || child == 0 {
+		t.Fatalf("Request served by %v expected new process", child)
+	}
+	syscall.Kill(child, syscall.SIGTERM)
+	p.waitFor(t, fmt.Sprintf("exit %v", child))
+}
+
+func TestRestartSystemdNotify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify")
+	notify, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer notify.Close()
+	// reads notifications until there's a pause
+	drain := func() []string {
+		var states []string
+		for {
+			notify.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			b := make([]byte, 256)
+			n, err := notify.Read(b)
+			if err != nil {
+				return states
+			}
+			states = append(states, string(b[:n]))
+		}
+	}
+
+	p := startTestProcess(t, "NOTIFY_SOCKET="+path)
+	defer p.cmd.Process.Kill()
+	parent := p.get(t)
+	p.cmd.Process.Signal(syscall.SIGHUP)
+	p.waitFor(t, fmt.Sprintf("exit %v", parent))
+	p.cmd.Wait()
+	child := p.get(t)
+
+	// the old process hands off without telling systemd it's stopping
+	// the new process's READY=1 can come after MAINPID
+	all := drain()
+	sort.Strings(all)
+	states := strings.Join(all, " ")
+	if expected := fmt.Sprintf("MAINPID=%d READY=1 READY=1", child); states != expected {
+		t.Errorf("Got %q expected %q", states, expected)
+	}
+	syscall.Kill(child, syscall.SIGTERM)
+	p.waitFor(t, fmt.Sprintf("exit %v", child))
+	if states := drain(); len(states) != 1 || states[0] != "STOPPING=1" {
+		t.Errorf("Got %q expected STOPPING=1 from the new process", states)
+	}
+}
+
+func TestRestartRollback(t *testing.T) {
+	p := startTestProcess(t, "RESTART_TEST_FAIL=1")
+	defer p.cmd.Process.Kill()
+	parent := p.get(t)
+
+	p.cmd.Process.Signal(syscall.SIGHUP)
+	p.waitFor(t, "restart failed")
+	for i := 0; i < 10; i++ {
+		if pid := p.get(t); pid != parent {
+			t.Fatalf("Request served by %v expected %v", pid, parent)
+		}
+	}
+
+	// a restart can be tried again after a rollback
+	p.cmd.Process.Signal(syscall.SIGHUP)
+	p.waitFor(t, "restart failed")
+
+	p.cmd.Process.Signal(syscall.SIGTERM)
+	p.waitFor(t, fmt.Sprintf("exit %v", parent))
+	p.cmd.Wait()
+}
+
+func TestRestartRollbackSystemdNotify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify")
+	notify, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer notify.Close()
+
+	p := startTestProcess(t, "NOTIFY_SOCKET="+path, "RESTART_TEST_FAIL=1")
+	defer p.cmd.Process.Kill()
+	parent := p.get(t)
+	p.cmd.Process.Signal(syscall.SIGHUP)
+	p.waitFor(t, "restart failed")
+
+	// the failed process hands back without telling systemd it's stopping
+	for {
+		notify.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		b := make([]byte, 256)
+		n, err := notify.Read(b)
+		if err != nil {
+			break
+		}
+		if state := string(b[:n]); state == "STOPPING=1" {
+			t.Errorf("Got %v from the failed process", state)
+		}
+	}
+	if pid := p.get(t); pid != parent {
+		t.Errorf("Request served by %v expected %v", pid, parent)
+	}
+
+	p.cmd.Process.Signal(syscall.SIGTERM)
+	p.waitFor(t, fmt.Sprintf("exit %v", parent))
+	p.cmd.Wait()
+}
@@ -2,33 +2,109 @@ package falcore
 
 import (
 	"bufio"
+	"context"
 	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"os"
-	"runtime"
-	"strconv"
+	"runtime/debug"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
 type Server struct {
-	Addr             string
-	Pipeline         *Pipeline
-	listener         net.Listener
-	listenerFile     *os.File
+	// host:port for tcp or the socket path for unix
+	Addr string
+	// "tcp" (the default) or "unix"
+	Network string
+	// The pipeline requests go through.  Don't change it or its filter
+	// lists once the server is running, use SwapPipeline instead.
+	Pipeline *Pipeline
+	// Permissions and ownership for unix sockets
+	UnixSocket UnixSocketOptions
+	// Read the PROXY protocol header on the default listener
+	ProxyProtocol *ProxyProtocol
+
+	// Maximum time to read the request headers.  Defaults to ReadTimeout.
+	ReadHeaderTimeout time.Duration
+	// Maximum time to read the entire request, including the body
+	ReadTimeout time.Duration
+	// Maximum time to wait for the next request on a keep-alive
+	// connection.  Defaults to ReadTimeout.
+	IdleTimeout time.Duration
+	// Maximum time to write the response once the pipeline is done
+	WriteTimeout time.Duration
+	// Close the connection after this many requests.  0 is unlimited.
+	MaxRequestsPerConn int
+	// Maximum number of open connections.  0 is unlimited.  At the limit
+	// the server stops accepting until a connection closes, unless
+	// RejectOverLimit is set.
+	MaxConnections int
+	// Maximum number of open connections from one client IP.  0 is
+	// unlimited.  Connections over the limit are answered with a 503.
+	MaxConnectionsPerIP int
+	// Answer connections over MaxConnections with a 503 instead of
+	// waiting for one to close
+	RejectOverLimit bool
+	// Don't offer HTTP/2 to TLS clients
+	DisableHTTP2 bool
+	// Accept HTTP/2 with prior knowledge (h2c) on cleartext connections
+	EnableH2C bool
+	// Client certificate verification for ListenAndServeTLS.  Listeners
+	// added with AddListener set these in their own TLSConfig.
+	ClientAuth tls.ClientAuthType
+	ClientCAs  *x509.CertPool
+	// Called when a connection changes state.  See ConnState.
+	ConnStateCallback func(c net.Conn, state ConnState)
+
+	listeners        []*Listener
+	defaultListener  *Listener
 	stopAccepting    chan int
+	stopOnce         sync.Once
+	acceptWaitGroup  *sync.WaitGroup
 	handlerWaitGroup *sync.WaitGroup
+	connMu           sync.Mutex
+	conns            map[net.Conn]ConnState
+	newConnDeadline  time.Time
 	logPrefix        string
 	AcceptReady      chan int
 	sendfile         bool
 	sockOpt          int
 	bufferPool       *bufferPool
+	timedOutConns    int64
+	baseCtx          context.Context
+	cancelBaseCtx    context.CancelFunc
+	connSlots        chan int
+	clientConns      map[string]int
+	openConns        int64
+	rejectedConns    int64
+	acceptWaits      int64
+	hijackedConns    int64
+	acceptedConns    int64
+	closedConns      int64
+	acceptErrors     int64
+	requests         int64
+	activeRequests   int64
+	connRequests     int64
+	acceptTimeout    time.Duration
+	stopTimeout      time.Duration
+	keepAlive        time.Duration
+	disableNoDelay   bool
+	reusePort        bool
+	acceptors        int
+	backlog          int
+	http2            *http2Server
+	handedOff        int32
+	// set by SwapPipeline
+	pipeline atomic.Value
 }
 
 func NewServer(port int, pipeline *Pipeline) *Server {
@@ -37,22 +113,18 @@ func NewServer(port int, pipeline *Pipeline) *Server {
 	s.Pipeline = pipeline
 	s.stopAccepting = make(chan int)
 	s.AcceptReady = make(chan int, 1)
+	s.acceptWaitGroup = new(sync.WaitGroup)
 	s.handlerWaitGroup = new(sync.WaitGroup)
+	s.conns = make(map[net.Conn]ConnState)
+	s.clientConns = make(map[string]int)
+	s.baseCtx, s.cancelBaseCtx = context.WithCancel(context.Background())
 	s.logPrefix = fmt.Sprintf("%d", syscall.Getpid())
 
-	// openbsd/netbsd don't have TCP_NOPUSH so it's likely sendfile will be slower
-	// without these socket options, just enable for linux, mac and freebsd.
-	// TODO (Graham) windows has TransmitFile zero-copy mechanism, try to use it
-	switch runtime.GOOS {
-	case "linux":
-		s.sendfile = true
-		s.sockOpt = 0x3 // syscall.TCP_CORK
-	case "freebsd", "darwin":
-		s.sendfile = true
-		s.sockOpt = 0x4 // syscall.TCP_NOPUSH
-	default:
-		s.sendfile = false
-	}
+	// see sockOpts for the platforms sendfile is used on
+	s.sockOpt = sockOpts().sendfile
+	s.sendfile = s.sockOpt != 0
+	s.acceptTimeout = 3 * time.Second
+	s.stopTimeout = 3 * time.Second
 
 	// buffer pool for reusing connection bufio.Readers
 	s.bufferPool = newBufferPool(100, 8192)
@@ -60,40 +132,99 @@ func NewServer(port int, pipeline *Pipeline) *Server {
 	return s
 }
 
+// Creates a server that listens on a unix domain socket at path
+func NewUnixServer(path string, pipeline *Pipeline) *Server {
+	s := NewServer(0, pipeline)
+	s.Network = "unix"
+	s.Addr = path
+	return s
+}
+
+// Sets up the default listener from an inherited socket file descriptor.
+// The socket can be TCP or unix.
 func (srv *Server) FdListen(fd int) error {
-	var err error
-	srv.listenerFile = os.NewFile(uintptr(fd), "")
-	if srv.listener, err = net.FileListener(srv.listenerFile); err != nil {
-		return err
+	return srv.setDefaultListener(&Listener{File: os.NewFile(uintptr(fd), "")})
+}
+
+func (srv *Server) setDefaultListener(l *Listener) error {
+	if l.ProxyProtocol == nil {
+		l.ProxyProtocol = srv.ProxyProtocol
 	}
-	if _, ok := srv.listener.(*net.TCPListener); !ok {
-		return errors.New("Broken listener isn't TCP")
+	if err := srv.AddListener(l); err != nil {
+		return err
 	}
+	srv.Network = l.Network
+	srv.defaultListener = l
 	return nil
 }
 
-func (srv *Server) socketListen() error {
-	var la *net.TCPAddr
-	var err error
-	if la, err = net.ResolveTCPAddr("tcp", srv.Addr); err != nil {
+// Adds a listener to the server.  It's opened immediately so errors
+// like the address being in use are returned here.  Listeners must be
+// added before the server starts serving.
+func (srv *Server) AddListener(l *Listener) error {
+	if err := l.open(srv); err != nil {
 		return err
 	}
+	if l.ProxyProtocol != nil && len(l.ProxyProtocol.Trusted) == 0 && l.Network != "unix" {
+		l.close()
+		return errors.New("ProxyProtocol needs Trusted networks for " + l.String())
+	}
+	srv.listeners = append(srv.listeners, l)
+	return nil
+}
 
-	var l *net.TCPListener
-	if l, err = net.ListenTCP("tcp", la); err != nil {
-		return err
+// All the listeners owned by the server
+func (srv *Server) Listeners() []*Listener {
+	return srv.listeners
+}
+
+// The listeners ListenAndServe opens from Addr, Network, UnixSocket,
+// ProxyProtocol and the ServerOptions.  There's more than one when
+// ServerOptions.Acceptors is set.  They aren't opened, so the restart
+// package can give them inherited sockets first.
+func (srv *Server) DefaultListeners() []*Listener {
+	l := &Listener{
+		Network:       srv.Network,
+		Addr:          srv.Addr,
+		UnixSocket:    srv.UnixSocket,
+		ProxyProtocol: srv.ProxyProtocol,
+		ReusePort:     srv.reusePort,
+		Backlog:       srv.backlog,
+	}
+	if srv.acceptors > 1 {
+		return ReusePortListeners(l, srv.acceptors)
 	}
-	srv.listener = l
-	// setup listener to be non-blocking if we're not on windows.
-	// this is required for hot restart to work.
-	return srv.setupNonBlockingListener(err, l)
+	return []*Listener{l}
 }
 
+// Opens the default listeners if they haven't been already
+func (srv *Server) socketListen() error {
+	if srv.defaultListener != nil {
+		return nil
+	}
+	ls := srv.DefaultListeners()
+	added := len(srv.listeners)
+	for _, l := range ls {
+		if err := srv.AddListener(l); err != nil {
+			// don't leave part of the set open
+			for _, opened := range srv.listeners[added:] {
+				opened.close()
+			}
+			srv.listeners = srv.listeners[:added]
+			return err
+		}
+	}
+	srv.defaultListener = ls[0]
+	return nil
+}
+
+// Serves on the default listener and any added with AddListener.  If
+// there are only added listeners, the default isn't created.
 func (srv *Server) ListenAndServe() error {
-	if srv.Addr == "" {
+	if srv.Addr == "" && srv.Network != "unix" {
 		srv.Addr = ":http"
 	}
-	if srv.listener == nil {
+	if len(srv.listeners) == 0 {
 		if err := srv.socketListen(); err != nil {
 			return err
 		}
@@ -101,12 +232,35 @@ func (srv *Server) ListenAndServe() error {
 	return srv.serve()
 }
 
+// Serves on the listeners added with AddListener or FdListen
+func (srv *Server) Serve() error {
+	if len(srv.listeners) == 0 {
+		return errors.New("Server has no listeners")
+	}
+	return srv.serve()
+}
+
+// The file descriptor of the default listener's socket
 func (srv *Server) SocketFd() int {
-	return int(srv.listenerFile.Fd())
+	if srv.defaultListener == nil {
+		return -1
+	}
+	return srv.defaultListener.Fd()
+}
+
+// The file descriptors of all the listeners' sockets in the same
+// order as Listeners()
+func (srv *Server) SocketFds() []int {
+	fds := make([]int, len(srv.listeners))
+	for i, l := range srv.listeners {
+		fds[i] = l.Fd()
+	}
+	return fds
 }
 
+// Serves TLS on the default listener along with any added with AddListener
 func (srv *Server) ListenAndServeTLS(certFile, keyFile string) error {
-	if srv.Addr == "" {
+	if srv.Addr == "" && srv.Network != "unix" {
 		srv.Addr = ":https"
 	}
 	config := &tls.Config{
@@ -114,6 +268,11 @@ func (srv *Server) ListenAndServeTLS(certFile, keyFile string) error {
 		Time:       time.Now,
 		NextProtos: []string{"http/1.1"},
 	}
+	if !srv.DisableHTTP2 {
+		config.NextProtos = []string{"h2", "http/1.1"}
+	}
+	config.ClientAuth = srv.ClientAuth
+	config.ClientCAs = srv.ClientCAs
 
 	var err error
 	config.Certificates = make([]tls.Certificate, 1)
@@ -122,51 +281,156 @@ func (srv *Server) ListenAndServeTLS(certFile, keyFile string) error {
 		return err
 	}
 
-	if srv.listener == nil {
-		if err := srv.socketListen(); err != nil {
-			return err
+	if err := srv.socketListen(); err != nil {
+		return err
+	}
+	for _, l := range srv.listeners {
+		if l == srv.defaultListener || l.reuseOf == srv.defaultListener {
+			l.TLSConfig = config
 		}
 	}
 
-	srv.listener = tls.NewListener(srv.listener, config)
-
 	return srv.serve()
 }
 
+// Stops accepting new connections.  The listener is closed immediately
+// and open connections are given a few seconds to send another request
+// before they are closed.  ListenAndServe returns once all the handlers
+// have finished.
 func (srv *Server) StopAccepting() {
-	close(srv.stopAccepting)
+	srv.stopOnce.Do(func() {
+		close(srv.stopAccepting)
+		if atomic.LoadInt32(&srv.handedOff) == 0 {
+			srv.systemdNotify("STOPPING=1")
+		}
+		// give connections that are waiting for a request a few
+		// seconds to send it
+		srv.connMu.Lock()
+		srv.newConnDeadline = time.Now().Add(srv.stopTimeout)
+		srv.expireConns(srv.newConnDeadline, true)
+		srv.connMu.Unlock()
+		for _, l := range srv.listeners {
+			l.close()
+		}
+		if srv.http2 != nil {
+			go srv.http2.shutdown()
+		}
+	})
 }
 
+// Gracefully shuts down the server.  The listener is closed immediately,
+// idle keep-alive connections are closed and in-flight requests are allowed
+// to finish.  Connections that were just accepted get a few seconds to
+// send their first request.  If ctx expires before all the handlers are
+// done, the contexts of the remaining requests are canceled, their
+// connections are forcibly closed and an error reporting how many were
+// cut off is returned.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.StopAccepting()
+	srv.connMu.Lock()
+	srv.expireConns(time.Now(), false)
+	srv.connMu.Unlock()
+
+	done := make(chan int)
+	go func() {
+		// an accept loop can still be starting a handler
+		srv.acceptWaitGroup.Wait()
+		srv.handlerWaitGroup.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	// whatever is still running should give up
+	srv.cancelBaseCtx()
+	n := srv.closeAllConns()
+	if n == 0 {
+		return nil
+	}
+	Warn("%s SERVER Shutdown forced %d connections closed", srv.serverLogPrefix(), n)
+	return fmt.Errorf("falcore: shutdown forced %d connections closed: %w", n, ctx.Err())
+}
+
+// The TCP port of the first listener that has one
 func (srv *Server) Port() int {
-	if l := srv.listener; l != nil {
-		a := l.Addr()
-		if _, p, e := net.SplitHostPort(a.String()); e == nil && p != "" {
-			server_port, _ := strconv.Atoi(p)
-			return server_port
+	for _, l := range srv.listeners {
+		if p := l.Port(); p != 0 {
+			return p
 		}
 	}
 	return 0
 }
 
 func (srv *Server) serve() (e error) {
-	var accept = true
+	http2 := srv.EnableH2C
+	for _, l := range srv.listeners {
+		l.start(srv)
+		if l.TLSConfig != nil && !srv.DisableHTTP2 {
+			http2 = true
+		}
+	}
+	if http2 {
+		srv.http2 = newHTTP2Server(srv)
+	}
+	if srv.MaxConnections > 0 {
+		srv.connSlots = make(chan int, srv.MaxConnections)
+	}
+	// each listener gets its own accept loop
+	for _, l := range srv.listeners {
+		srv.acceptWaitGroup.Add(1)
+		go func(l *Listener) {
+			srv.acceptLoop(l)
+			srv.acceptWaitGroup.Done()
+		}(l)
+	}
 	srv.AcceptReady <- 1
+	srv.systemdNotify("READY=1")
+	srv.acceptWaitGroup.Wait()
+	Trace("Stopped accepting, waiting for handlers")
+	// wait for handlers
+	srv.handlerWaitGroup.Wait()
+	return nil
+}
+
+func (srv *Server) acceptLoop(l *Listener) {
+	var accept = true
 	for accept {
-		var c net.Conn
-		if l, ok := srv.listener.(*net.TCPListener); ok {
-			l.SetDeadline(time.Now().Add(3e9))
+		if !srv.waitConnSlot() {
+			break
+		}
+		l.raw.SetDeadline(time.Now().Add(srv.acceptTimeout))
+		c, e := l.listener.Accept()
+		if e != nil && !srv.RejectOverLimit {
+			// give back the slot waited for
+			srv.releaseConnSlot()
 		}
-		c, e = srv.listener.Accept()
-		if e != nil {
+		if e != nil && srv.stopping() {
+			// listener was closed by StopAccepting
+			break
+		} else if e != nil {
 			if ope, ok := e.(*net.OpError); ok {
 				if !(ope.Timeout() && ope.Temporary()) {
-					Error("%s SERVER Accept Error: %v", srv.serverLogPrefix(), ope)
+					atomic.AddInt64(&srv.acceptErrors, 1)
+					Error("%s SERVER Accept Error on %v: %v", srv.serverLogPrefix(), l, ope)
 				}
 			} else {
-				Error("%s SERVER Accept Error: %v", srv.serverLogPrefix(), e)
+				atomic.AddInt64(&srv.acceptErrors, 1)
+				Error("%s SERVER Accept Error on %v: %v", srv.serverLogPrefix(), l, e)
 			}
+		} else if atomic.AddInt64(&srv.acceptedConns, 1); !srv.takeConnSlot() {
+			srv.handlerWaitGroup.Add(1)
+			go func() {
+				srv.rejectConn(c)
+				c.Close()
+				srv.handlerWaitGroup.Done()
+			}()
 		} else {
 			//Trace("Handling!")
+			atomic.AddInt64(&srv.openConns, 1)
 			srv.handlerWaitGroup.Add(1)
 			go srv.handler(c)
 		}
@@ -176,60 +440,129 @@ func (srv *Server) serve() (e error) {
 		default:
 		}
 	}
-	Trace("Stopped accepting, waiting for handlers")
-	// wait for handlers
-	srv.handlerWaitGroup.Wait()
-	return nil
 }
 
-func (srv *Server) sentinel(c net.Conn, connClosed chan int) {
+func (srv *Server) stopping() bool {
 	select {
 	case <-srv.stopAccepting:
-		c.SetReadDeadline(time.Now().Add(3 * time.Second))
-	case <-connClosed:
+		return true
+	default:
 	}
+	return false
 }
 
 func (srv *Server) handler(c net.Conn) {
+	if srv.MaxConnectionsPerIP > 0 {
+		ip, ok := srv.addClientConn(c)
+		if !ok {
+			srv.rejectConn(c)
+			srv.connectionFinished(c)
+			return
+		}
+		defer srv.removeClientConn(ip)
+	}
 	startTime := time.Now()
+	defer srv.connectionFinished(c)
+	// the buffer goes back before the connection is counted as closed
 	bpe := srv.bufferPool.take(c)
 	defer srv.bufferPool.give(bpe)
-	var closeSentinelChan = make(chan int)
-	go srv.sentinel(c, closeSentinelChan)
-	defer srv.connectionFinished(c, closeSentinelChan)
+	// the pipeline recovers its own panics.  this catches anything else
+	// so the connection is closed instead of taking down the server.
+	defer func() {
+		if err := recover(); err != nil {
+			Error("%s %v PANIC handling connection: %v\n%s", srv.serverLogPrefix(), c.RemoteAddr(), err, debug.Stack())
+		}
+	}()
 	var err error
 	var req *http.Request
-	// no keepalive (for now)
 	reqCount := 0
+	// rejected connections aren't counted so they don't lower
+	// RequestsPerConnection
+	defer func() {
+		atomic.AddInt64(&srv.connRequests, int64(reqCount))
+		atomic.AddInt64(&srv.closedConns, 1)
+	}()
 	keepAlive := true
 	for err == nil && keepAlive {
+		phase := "header"
+		readStart := time.Now()
+		if reqCount == 0 {
+			if !srv.setConnState(c, StateNew, timeoutDeadline(readStart, srv.headerTimeout())) {
+				break
+			}
+			if srv.http2 != nil {
+				if h2, err := srv.http2.detect(c, bpe.br); h2 || err != nil {
+					if err != nil {
+						srv.readError(c, phase, err)
+					}
+					break
+				}
+			}
+		} else if bpe.br.Buffered() == 0 {
+			// wait for the first byte of the next request.  a pipelined
+			// request may already be buffered, in which case the
+			// connection never goes idle
+			phase = "idle"
+			if !srv.setConnState(c, StateIdle, timeoutDeadline(readStart, srv.idleTimeout())) {
+				// shutting down, don't wait for another request
+				break
+			}
+			if _, err = bpe.br.Peek(1); err != nil {
+				srv.readError(c, phase, err)
+				break
+			}
+			phase = "header"
+			readStart = time.Now()
+			srv.setConnState(c, StateActive, timeoutDeadline(readStart, srv.headerTimeout()))
+		} else {
+			c.SetReadDeadline(timeoutDeadline(readStart, srv.headerTimeout()))
+		}
 		if req, err = http.ReadRequest(bpe.br); err == nil {
-			if req.Header.Get("Connection") != "Keep-Alive" {
-				keepAlive = false
+			srv.setConnState(c, StateActive, timeoutDeadline(readStart, srv.ReadTimeout))
+			if tc, ok := c.(*tls.Conn); ok {
+				state := tc.ConnectionState()
+				req.TLS = &state
 			}
-			request := newRequest(req, c, startTime)
+			// ReadRequest applies the RFC 7230 rules: HTTP/1.1 is persistent
+			// unless the client sends close, HTTP/1.0 only if it asks for keep-alive
+			keepAlive = !req.Close
 			reqCount++
-			var res *http.Response
-
-			pssInit := new(PipelineStageStat)
-			pssInit.Name = "server.Init"
-			pssInit.StartTime = startTime
-			pssInit.EndTime = time.Now()
-			request.appendPipelineStage(pssInit)
-			// execute the pipeline
-			if res = srv.Pipeline.execute(request); res == nil {
-				res = SimpleResponse(req, 404, nil, "Not Found")
+			ctx, cancel := context.WithCancel(srv.baseCtx)
+			req = req.WithContext(ctx)
+			ec := srv.expectContinue(c, req)
+			// without a body to read, a read error while the pipeline
+			// runs means the client is gone
+			var bg *backgroundRead
+			if req.ContentLength == 0 && len(req.TransferEncoding) == 0 {
+				c.SetReadDeadline(time.Time{})
+				bg = startBackgroundRead(c, bpe.br, cancel)
+			}
+			request, res := srv.handleRequest(req, c, startTime)
+			// a stream keeps watching for the client to hang up while
+			// it's written
+			sb := streamResponseBody(res)
+			if bg != nil && sb == nil {
+				bg.stop()
+			}
+			if handler := upgradeHandler(res); handler != nil {
+				// falcore is done with the connection once the handler has it
+				srv.upgradeConn(c, bpe.br, request, res, handler)
+				cancel()
+				return
+			}
+			// Close drains whatever the pipeline didn't read so the next
+			// pipelined request starts at the right place
+			if req.Body.Close() != nil {
+				keepAlive = false
 			}
-			// cleanup
-			request.startPipelineStage("server.ResponseWrite")
-			req.Body.Close()
 
-			// shutting down?
-			select {
-			case <-srv.stopAccepting:
+			// the response can end the connection too
+			if res.Close || headerHasToken(res.Header, "Connection", "close") {
+				keepAlive = false
+			}
+			// shutting down or used up?
+			if srv.stopping() || (srv.MaxRequestsPerConn > 0 && reqCount >= srv.MaxRequestsPerConn) {
 				keepAlive = false
-				res.Close = true
-			default:
 			}
 			// The res.Write omits Content-length on 0 length bodies, and by spec,
 			// it SHOULD. While this is not MUST, it's kinda broken.  See sec 4.4
@@ -239,65 +572,323 @@ func (srv *Server) handler(c net.Conn) {
 			// content length to write if it was 0.
 			// Specifically, the android http client waits forever if there's no
 			// content-length instead of assuming zero at the end of headers. der.
+			// trailers come after the last chunk
+			if len(res.Trailer) > 0 && req.ProtoAtLeast(1, 1) && res.Body != nil && bodyAllowedForStatus(res.StatusCode) {
+				res.ContentLength = -1
+			}
 			if res.ContentLength == 0 && len(res.TransferEncoding) == 0 && !((res.StatusCode-100 < 100) || res.StatusCode == 204 || res.StatusCode == 304) {
 				res.TransferEncoding = []string{"identity"}
 			}
 			if res.ContentLength < 0 {
-				res.TransferEncoding = []string{"chunked"}
+				if req.ProtoAtLeast(1, 1) {
+					res.TransferEncoding = []string{"chunked"}
+				} else {
+					// HTTP/1.0 doesn't do chunked so the end of the body
+					// is marked by closing the connection
+					res.TransferEncoding = nil
+					keepAlive = false
+				}
 			}
 
-			// For HTTP/1.0 and Keep-Alive, sending the Connection: Keep-Alive response header is required
+			// Tell the client when we're closing.  For HTTP/1.0 and Keep-Alive,
+			// sending the Connection: Keep-Alive response header is required
 			// because close is default (opposite of 1.1)
-			if keepAlive && !req.ProtoAtLeast(1, 1) {
-				res.Header.Add("Connection", "Keep-Alive")
+			if !keepAlive {
+				res.Close = true
+			} else if !req.ProtoAtLeast(1, 1) {
+				res.Header.Set("Connection", "Keep-Alive")
 			}
 
 			// write response
-			if srv.sendfile {
-				res.Write(c)
+			if srv.WriteTimeout > 0 {
+				c.SetWriteDeadline(time.Now().Add(srv.WriteTimeout))
+			}
+			var werr error
+			if sb != nil {
+				werr = srv.writeStream(c, req, res, sb)
+				if bg != nil {
+					bg.stop()
+				}
+			} else if srv.sendfile {
+				werr = res.Write(c)
 				srv.cycleNonBlock(c)
 			} else {
 				wbuf := bufio.NewWriter(c)
-				res.Write(wbuf)
-				wbuf.Flush()
+				if werr = res.Write(wbuf); werr == nil {
+					werr = wbuf.Flush()
+				}
 			}
-			if res.Body != nil {
-				res.Body.Close()
+			srv.finishRequest(request, res)
+			cancel()
+			if ec != nil && !ec.continued() && werr == nil {
+				// the client may send the body anyway once it's tired
+				// of waiting for 100 Continue
+				lingerClose(c)
 			}
-			request.finishPipelineStage()
-			request.finishRequest()
-			srv.requestFinished(request)
 
-			if res.Close {
+			if werr != nil {
+				// the connection is in an unknown state
 				keepAlive = false
+				if nerr, ok := werr.(net.Error); ok && nerr.Timeout() {
+					srv.connTimedOut(c, "write")
+				}
 			}
 
 			// Reset the startTime
 			// this isn't great since there may be lag between requests; but it's the best we've got
 			startTime = time.Now()
 		} else {
-			// EOF is socket closed
-			if nerr, ok := err.(net.Error); err != io.EOF && !(ok && nerr.Timeout()) {
-				Error("%s %v ERROR reading request: <%T %v>", srv.serverLogPrefix(), c.RemoteAddr(), err, err)
-			}
+			srv.readError(c, phase, err)
 		}
 	}
 	//Debug("%s Processed %v requests on connection %v", srv.serverLogPrefix(), reqCount, c.RemoteAddr())
 }
 
+// Watches a connection while the pipeline runs and cancels the request's
+// context if the client hangs up
+type backgroundRead struct {
+	c       net.Conn
+	done    chan int
+	stopped int32
+}
+
+func startBackgroundRead(c net.Conn, br *bufio.Reader, cancel context.CancelFunc) *backgroundRead {
+	bg := &backgroundRead{c: c, done: make(chan int)}
+	go func() {
+		defer close(bg.done)
+		// a pipelined request can arrive too, that's fine
+		if _, err := br.Peek(1); err != nil && atomic.LoadInt32(&bg.stopped) == 0 {
+			cancel()
+		}
+	}()
+	return bg
+}
+
+// Stops watching.  The read deadline has to be set again afterwards.
+func (bg *backgroundRead) stop() {
+	atomic.StoreInt32(&bg.stopped, 1)
+	bg.c.SetReadDeadline(time.Unix(1, 0))
+	<-bg.done
+}
+
+// Reports whether the comma separated header field contains token.
+// Tokens are case insensitive.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (srv *Server) idleTimeout() time.Duration {
+	if srv.IdleTimeout > 0 {
+		return srv.IdleTimeout
+	}
+	return srv.ReadTimeout
+}
+
+func (srv *Server) headerTimeout() time.Duration {
+	if srv.ReadHeaderTimeout > 0 {
+		return srv.ReadHeaderTimeout
+	}
+	return srv.ReadTimeout
+}
+
+// Logs errors reading a request.  phase is what the connection was
+// waiting for when the error happened.
+func (srv *Server) readError(c net.Conn, phase string, err error) {
+	if err == io.EOF || srv.stopping() {
+		// EOF is socket closed
+		return
+	}
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		srv.connTimedOut(c, phase)
+		return
+	}
+	Error("%s %v ERROR reading request: <%T %v>", srv.serverLogPrefix(), c.RemoteAddr(), err, err)
+}
+
+func (srv *Server) connTimedOut(c net.Conn, phase string) {
+	atomic.AddInt64(&srv.timedOutConns, 1)
+	if phase == "idle" {
+		Debug("%s %v Idle connection timed out", srv.serverLogPrefix(), c.RemoteAddr())
+	} else {
+		Warn("%s %v Connection timed out during %s", srv.serverLogPrefix(), c.RemoteAddr(), phase)
+	}
+}
+
+// The number of client connections closed because of a timeout
+func (srv *Server) TimedOutConnections() int64 {
+	return atomic.LoadInt64(&srv.timedOutConns)
+}
+
 func (srv *Server) serverLogPrefix() string {
 	return srv.logPrefix
 }
 
+// Runs the request through the pipeline and starts the server.ResponseWrite
+// stage.  This is shared by the HTTP/1 and HTTP/2 connection handlers.
+func (srv *Server) handleRequest(req *http.Request, c net.Conn, startTime time.Time) (*Request, *http.Response) {
+	atomic.AddInt64(&srv.requests, 1)
+	atomic.AddInt64(&srv.activeRequests, 1)
+	request := newRequest(req, c, startTime)
+	request.stopping = srv.stopAccepting
+	var res *http.Response
+
+	pssInit := new(PipelineStageStat)
+	pssInit.Name = "server.Init"
+	pssInit.StartTime = startTime
+	pssInit.EndTime = time.Now()
+	request.appendPipelineStage(pssInit)
+	// the request keeps this pipeline even if it's swapped
+	request.pipeline = srv.CurrentPipeline()
+	// execute the pipeline
+	if res = request.pipeline.execute(request); res == nil {
+		res = SimpleResponse(req, 404, nil, "Not Found")
+	}
+	// cleanup
+	request.startPipelineStage("server.ResponseWrite")
+	return request, res
+}
+
+// Replaces the pipeline while the server is running and returns the old
+// one.  Requests already in the old pipeline finish with it and new
+// requests get p.  p must be completely built first and mustn't be
+// changed after it's swapped in.  Build a new one, or change a Clone, to
+// make another change.
+func (srv *Server) SwapPipeline(p *Pipeline) *Pipeline {
+	old := srv.CurrentPipeline()
+	srv.pipeline.Store(p)
+	return old
+}
+
+// The pipeline new requests go through
+func (srv *Server) CurrentPipeline() *Pipeline {
+	if p, _ := srv.pipeline.Load().(*Pipeline); p != nil {
+		return p
+	}
+	return srv.Pipeline
+}
+
+// Call once the response has been written
+func (srv *Server) finishRequest(request *Request, res *http.Response) {
+	if res.Body != nil {
+		res.Body.Close()
+	}
+	request.finishPipelineStage()
+	request.finishRequest()
+	atomic.AddInt64(&srv.activeRequests, -1)
+	srv.requestFinished(request)
+}
+
 func (srv *Server) requestFinished(request *Request) {
-	if srv.Pipeline.RequestDoneCallback != nil {
+	if cb := request.pipeline.RequestDoneCallback; cb != nil {
 		// Don't block the connecion for this
-		go srv.Pipeline.RequestDoneCallback.FilterRequest(request)
+		go func() {
+			defer func() {
+				if err := recover(); err != nil {
+					Error("%s PANIC in RequestDoneCallback: %v\n%s", request.ID, err, debug.Stack())
+				}
+			}()
+			cb.FilterRequest(request)
+		}()
 	}
 }
 
-func (srv *Server) connectionFinished(c net.Conn, closeChan chan int) {
+func (srv *Server) connectionFinished(c net.Conn) {
 	c.Close()
-	close(closeChan)
+	srv.connMu.Lock()
+	_, known := srv.conns[c]
+	delete(srv.conns, c)
+	srv.connMu.Unlock()
+	if known {
+		srv.connStateChanged(c, StateClosed)
+	}
+	srv.releaseConnSlot()
+	atomic.AddInt64(&srv.openConns, -1)
 	srv.handlerWaitGroup.Done()
 }
+
+// Shuts the write side of c and throws away what the client sends for a
+// little while.  Closing with unread data makes the kernel reset the
+// connection and the client can lose the response that was just written.
+// The caller closes c.
+func lingerClose(c net.Conn) {
+	if tc, ok := c.(*tls.Conn); ok {
+		tc.CloseWrite()
+		c = tc.NetConn()
+	}
+	if pc, ok := c.(*proxyConn); ok {
+		c = pc.Conn
+	}
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+	c.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	io.CopyN(io.Discard, c, 256<<10)
+}
+
+// Records the connection state and sets its read deadline.  This is
+// done under the lock so it can't race with expireConns.  Returns
+// false if the connection is idle between requests while the server is
+// shutting down.  In that case the handler should close it.
+func (srv *Server) setConnState(c net.Conn, state ConnState, readDeadline time.Time) bool {
+	srv.connMu.Lock()
+	if srv.stopping() {
+		switch state {
+		case StateIdle:
+			srv.connMu.Unlock()
+			return false
+		case StateNew:
+			// accepted just before the listener closed.  the client
+			// still gets a chance to send its request, which matters
+			// when another process is taking over the socket.
+			if readDeadline.IsZero() || readDeadline.After(srv.newConnDeadline) {
+				readDeadline = srv.newConnDeadline
+			}
+		}
+	}
+	prev, known := srv.conns[c]
+	srv.conns[c] = state
+	c.SetReadDeadline(readDeadline)
+	srv.connMu.Unlock()
+	if !known || prev != state {
+		srv.connStateChanged(c, state)
+	}
+	return true
+}
+
+// The deadline for a timeout starting at start.  A zero timeout means
+// no deadline.
+func timeoutDeadline(start time.Time, timeout time.Duration) time.Time {
+	if timeout > 0 {
+		return start.Add(timeout)
+	}
+	return time.Time{}
+}
+
+// Sets a read deadline on connections that are waiting for a request.
+// The handler exits quietly when it expires.  Connections that haven't
+// sent their first request are only included if includeNew is set.
+// Must be called with connMu held.
+func (srv *Server) expireConns(deadline time.Time, includeNew bool) {
+	for c, state := range srv.conns {
+		if state == StateIdle || (state == StateNew && includeNew) {
+			c.SetReadDeadline(deadline)
+		}
+	}
+}
+
+// Forcibly closes all open connections and returns how many there were
+func (srv *Server) closeAllConns() int {
+	srv.connMu.Lock()
+	defer srv.connMu.Unlock()
+	for c := range srv.conns {
+		c.Close()
+	}
+	return len(srv.conns)
+}
@@ -8,16 +8,23 @@ import (
 )
 
 // only valid on non-windows
-func (srv *Server) setupNonBlockingListener(err error, l *net.TCPListener) error {
-	// FIXME: File() returns a copied pointer.  we're leaking it.  probably doesn't matter
-	if srv.listenerFile, err = l.File(); err != nil {
+func (srv *Server) setupNonBlockingListener(l *Listener) (err error) {
+	// File() returns a copy which is kept open for hot restart
+	if l.file, err = l.raw.File(); err != nil {
 		return err
 	}
-	fd := int(srv.listenerFile.Fd())
+	fd := int(l.file.Fd())
+	l.fd = fd
 	if e := syscall.SetNonblock(fd, true); e != nil {
 		return e
 	}
-	if srv.sendfile {
+	if l.Backlog > 0 && l.File == nil {
+		// listening again only changes the queue length
+		if e := syscall.Listen(fd, l.Backlog); e != nil {
+			return e
+		}
+	}
+	if _, isTCP := l.raw.(*net.TCPListener); srv.sendfile && isTCP {
 		if e := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, srv.sockOpt, 1); e != nil {
 			return e
 		}
@@ -25,8 +32,27 @@ func (srv *Server) setupNonBlockingListener(err error, l *net.TCPListener) error
 	return nil
 }
 
+// Sets SO_REUSEPORT on a socket before it's bound
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, sockOpts().reusePort, 1)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+func closeOnExec(fd int) {
+	syscall.CloseOnExec(fd)
+}
+
 func (srv *Server) cycleNonBlock(c net.Conn) {
 	if srv.sendfile {
+		if pc, ok := c.(*proxyConn); ok {
+			c = pc.Conn
+		}
 		if tcpC, ok := c.(*net.TCPConn); ok {
 			if f, err := tcpC.File(); err == nil {
 				// f is a copy.  must be closed
@@ -0,0 +1,697 @@
+package falcore
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// starts srv on a random port and waits for it to be accepting
+func startTestServer(t *testing.T, srv *Server) chan error {
+	if err := srv.socketListen(); err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.ListenAndServe()
+	}()
+	<-srv.AcceptReady
+	return errc
+}
+
+func okFilter(req *Request) *http.Response {
+	return SimpleResponse(req.HttpRequest, 200, nil, "OK")
+}
+
+func testDial(t *testing.T, srv *Server) (net.Conn, *bufio.Reader) {
+	c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", srv.Port()))
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	return c, bufio.NewReader(c)
+}
+
+func TestShutdownIdle(t *testing.T) {
+	p := NewPipeline()
+	p.Upstream.PushBack(NewRequestFilter(okFilter))
+	srv := NewServer(0, p)
+	errc := startTestServer(t, srv)
+
+	// leave a keep-alive connection idle
+	c, br := testDial(t, srv)
+	defer c.Close()
+	fmt.Fprintf(c, "GET / HTTP/1.1\r\nHost: test\r\nConnection: Keep-Alive\r\n\r\n")
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("Could not read response: %v", err)
+	}
+	res.Body.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown returned error: %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Shutdown took too long: %v", d)
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("ListenAndServe returned error: %v", err)
+	}
+}
+
+func TestShutdownWhileAccepting(t *testing.T) {
+	p := NewPipeline()
+	p.Upstream.PushBack(NewRequestFilter(okFilter))
+	srv := NewServer(0, p)
+	errc := startTestServer(t, srv)
+
+	// connections keep arriving while the server shuts down
+	stop := make(chan int)
+	dialed := make(chan int)
+	addr := fmt.Sprintf("127.0.0.1:%d", srv.Port())
+	for i := 0; i < 4; i++ {
+		go func() {
+			defer func() { dialed <- 1 }()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if c, err := net.Dial("tcp", addr); err == nil {
+					c.Close()
+				}
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown returned error: %v", err)
+	}
+	// every handler has finished once Shutdown returns
+	if n := srv.Stats().OpenConnections; n != 0 {
+		t.Errorf("%v connections still open after Shutdown", n)
+	}
+	close(stop)
+	for i := 0; i < 4; i++ {
+		<-dialed
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("ListenAndServe returned error: %v", err)
+	}
+}
+
+func TestShutdownForced(t *testing.T) {
+	p := NewPipeline()
+	block := make(chan int)
+	entered := make(chan int)
+	p.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		close(entered)
+		<-block
+		return nil
+	}))
+	srv := NewServer(0, p)
+	errc := startTestServer(t, srv)
+	defer close(block)
+
+	c, _ := testDial(t, srv)
+	defer c.Close()
+	fmt.Fprintf(c, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+	<-entered
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := srv.Shutdown(ctx)
+	if err == nil || !strings.Contains(err.Error(), "1 connections") {
+		t.Errorf("Expected forced shutdown error, got: %v", err)
+	}
+
+	// a new connection should be refused
+	if c2, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", srv.Port())); err == nil {
+		c2.Close()
+		t.Errorf("Listener still accepting after shutdown")
+	}
+	block <- 1
+	if err := <-errc; err != nil {
+		t.Errorf("ListenAndServe returned error: %v", err)
+	}
+}
+
+func TestReadHeaderTimeout(t *testing.T) {
+	p := NewPipeline()
+	p.Upstream.PushBack(NewRequestFilter(okFilter))
+	srv := NewServer(0, p)
+	srv.ReadHeaderTimeout = 50 * time.Millisecond
+	srv.IdleTimeout = 50 * time.Millisecond
+	startTestServer(t, srv)
+	defer srv.Shutdown(context.Background())
+
+	// partial headers
+	c, br := testDial(t, srv)
+	defer c.Close()
+	fmt.Fprintf(c, "GET / HTTP/1.1\r\nHost: te")
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := br.ReadByte(); err == nil {
+		t.Errorf("Expected connection to be closed")
+	}
+
+	// idle keep-alive
+	c2, br2 := testDial(t, srv)
+	defer c2.Close()
+	fmt.Fprintf(c2, "GET / HTTP/1.1\r\nHost: test\r\nConnection: Keep-Alive\r\n\r\n")
+	res, err := http.ReadResponse(br2, nil)
+	if err != nil {
+		t.Fatalf("Could not read response: %v", err)
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	c2.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := br2.ReadByte(); err == nil {
+		t.Errorf("Expected idle connection to be closed")
+	}
+
+	if n := srv.TimedOutConnections(); n != 2 {
+		t.Errorf("Timed out connection count: %v expected %v", n, 2)
+	}
+}
+
+func TestMaxRequestsPerConn(t *testing.T) {
+	p := NewPipeline()
+	p.Upstream.PushBack(NewRequestFilter(okFilter))
+	srv := NewServer(0, p)
+	srv.MaxRequestsPerConn = 2
+	startTestServer(t, srv)
+	defer srv.Shutdown(context.Background())
+
+	c, br := testDial(t, srv)
+	defer c.Close()
+	for i := 1; i <= 2; i++ {
+		fmt.Fprintf(c, "GET / HTTP/1.1\r\nHost: test\r\nConnection: Keep-Alive\r\n\r\n")
+		res, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("Could not read response %v: %v", i, err)
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		if res.Close != (i == 2) {
+			t.Errorf("Response %v Close: %v", i, res.Close)
+		}
+	}
+}
+
+var persistenceTests = []struct {
+	name      string
+	request   string
+	keepAlive bool
+}{
+	{"1.1 default", "GET / HTTP/1.1\r\nHost: test\r\n\r\n", true},
+	{"1.1 close", "GET / HTTP/1.1\r\nHost: test\r\nConnection: close\r\n\r\n", false},
+	{"1.1 token list", "GET / HTTP/1.1\r\nHost: test\r\nConnection: TE, Close\r\n\r\n", false},
+	{"1.0 default", "GET / HTTP/1.0\r\n\r\n", false},
+	{"1.0 keep-alive", "GET / HTTP/1.0\r\nConnection: keep-alive\r\n\r\n", true},
+}
+
+func TestPersistentConnections(t *testing.T) {
+	p := NewPipeline()
+	p.Upstream.PushBack(NewRequestFilter(okFilter))
+	srv := NewServer(0, p)
+	startTestServer(t, srv)
+	defer srv.Shutdown(context.Background())
+
+	for _, test := range persistenceTests {
+		c, br := testDial(t, srv)
+		c.SetDeadline(time.Now().Add(time.Second))
+		io.WriteString(c, test.request)
+		res, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Errorf("%v: Could not read response: %v", test.name, err)
+			c.Close()
+			continue
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		if res.Close == test.keepAlive {
+			t.Errorf("%v: Response Close: %v", test.name, res.Close)
+		}
+		// the server should close the connection or wait for another request
+		_, err = br.ReadByte()
+		if nerr, ok := err.(net.Error); test.keepAlive != (ok && nerr.Timeout()) {
+			t.Errorf("%v: Unexpected connection state after response: %v", test.name, err)
+		}
+		c.Close()
+	}
+}
+
+func TestPipelinedRequests(t *testing.T) {
+	p := NewPipeline()
+	p.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		// leave the body unread
+		return SimpleResponse(req.HttpRequest, 200, nil, req.HttpRequest.URL.Path)
+	}))
+	srv := NewServer(0, p)
+	startTestServer(t, srv)
+	defer srv.Shutdown(context.Background())
+
+	c, br := testDial(t, srv)
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(time.Second))
+	io.WriteString(c, "POST /one HTTP/1.1\r\nHost: test\r\nContent-Length: 5\r\n\r\nhello"+
+		"GET /two HTTP/1.1\r\nHost: test\r\n\r\n"+
+		"GET /three HTTP/1.1\r\nHost: test\r\nConnection: close\r\n\r\n")
+	for _, path := range []string{"/one", "/two", "/three"} {
+		res, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("Could not read response for %v: %v", path, err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if string(body) != path {
+			t.Errorf("Response body: %q expected %q", body, path)
+		}
+	}
+}
+
+func TestMultipleListeners(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, t.TempDir(), "localhost")
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Could not load cert: %v", err)
+	}
+	p := NewPipeline()
+	p.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		return SimpleResponse(req.HttpRequest, 200, nil, fmt.Sprint(req.HttpRequest.TLS != nil))
+	}))
+	srv := NewServer(0, p)
+	plain := &Listener{Name: "http", Addr: "127.0.0.1:0"}
+	secure := &Listener{Name: "https", Addr: "127.0.0.1:0", TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}}}
+	for _, l := range []*Listener{plain, secure} {
+		if err := srv.AddListener(l); err != nil {
+			t.Fatalf("Could not add listener %v: %v", l, err)
+		}
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.Serve()
+	}()
+	<-srv.AcceptReady
+
+	for i, fd := range srv.SocketFds() {
+		if fd < 0 {
+			t.Errorf("Listener %v has no fd", srv.Listeners()[i])
+		}
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	urls := map[string]string{
+		fmt.Sprintf("http://127.0.0.1:%d/", plain.Port()):   "false",
+		fmt.Sprintf("https://127.0.0.1:%d/", secure.Port()): "true",
+	}
+	for url, expected := range urls {
+		res, err := client.Get(url)
+		if err != nil {
+			t.Errorf("Request to %v failed: %v", url, err)
+			continue
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if string(body) != expected {
+			t.Errorf("Request to %v TLS: %s expected %v", url, body, expected)
+		}
+	}
+	client.CloseIdleConnections()
+
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown returned error: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("Serve returned error: %v", err)
+	}
+	for url := range urls {
+		if _, err := client.Get(url); err == nil {
+			t.Errorf("Listener still accepting after shutdown: %v", url)
+		}
+	}
+}
+
+func TestClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "localhost")
+	clientCertFile, clientKeyFile := writeTestCert(t, dir, "client.example.com")
+	pool, err := LoadCertPool(clientCertFile)
+	if err != nil {
+		t.Fatalf("Could not load CA pool: %v", err)
+	}
+
+	p := NewPipeline()
+	p.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		cert := req.ClientCertificate()
+		if cert == nil {
+			return SimpleResponse(req.HttpRequest, 403, nil, "Forbidden")
+		}
+		body := fmt.Sprintf("%s %v", cert.Subject.CommonName, req.CipherSuite() != "")
+		return SimpleResponse(req.HttpRequest, 200, nil, body)
+	}))
+	srv := NewServer(0, p)
+	srv.ClientAuth = tls.RequireAndVerifyClientCert
+	srv.ClientCAs = pool
+	if err := srv.socketListen(); err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	go srv.ListenAndServeTLS(certFile, keyFile)
+	<-srv.AcceptReady
+	defer srv.Shutdown(context.Background())
+	url := fmt.Sprintf("https://localhost:%d/", srv.Port())
+
+	clientCert, _ := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{clientCert}},
+	}}
+	res, err := client.Get(url)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "client.example.com true" {
+		t.Errorf("Unexpected response: %q", body)
+	}
+
+	// no client certificate
+	client = &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	if res, err := client.Get(url); err == nil {
+		res.Body.Close()
+		t.Errorf("Expected request without client certificate to fail, got %v", res.Status)
+	}
+}
+
+func TestRequestContextCanceled(t *testing.T) {
+	canceled := make(chan error, 1)
+	p := NewPipeline()
+	p.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		select {
+		case <-req.Ctx().Done():
+			canceled <- req.Ctx().Err()
+		case <-time.After(5 * time.Second):
+			canceled <- nil
+		}
+		return SimpleResponse(req.HttpRequest, 200, nil, "OK")
+	}))
+	srv := NewServer(0, p)
+	startTestServer(t, srv)
+	defer srv.Shutdown(context.Background())
+
+	// client hangs up while the filter is running
+	c, _ := testDial(t, srv)
+	io.WriteString(c, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+	time.Sleep(50 * time.Millisecond)
+	c.Close()
+	if err := <-canceled; err != context.Canceled {
+		t.Errorf("Context error %v expected %v", err, context.Canceled)
+	}
+}
+
+func TestDeadlineFilter(t *testing.T) {
+	p := NewPipeline()
+	p.Upstream.PushBack(NewDeadlineFilter(50 * time.Millisecond))
+	p.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		select {
+		case <-req.HttpRequest.Context().Done():
+			return SimpleResponse(req.HttpRequest, 504, nil, req.Ctx().Err().Error())
+		case <-time.After(5 * time.Second):
+			return SimpleResponse(req.HttpRequest, 200, nil, "OK")
+		}
+	}))
+	srv := NewServer(0, p)
+	startTestServer(t, srv)
+	defer srv.Shutdown(context.Background())
+
+	// the connection stays usable after the deadline
+	c, br := testDial(t, srv)
+	defer c.Close()
+	for i := 0; i < 2; i++ {
+		io.WriteString(c, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+		res, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("Could not read response: %v", err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != 504 || string(body) != context.DeadlineExceeded.Error() {
+			t.Errorf("Got %v %q expected the deadline to pass", res.StatusCode, body)
+		}
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	p := NewPipeline()
+	p.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		if req.HttpRequest.Header.Get("Upgrade") != "echo" {
+			return SimpleResponse(req.HttpRequest, 400, nil, "Bad Request")
+		}
+		return NewUpgradeResponse(req, "echo", func(c net.Conn, br *bufio.Reader) {
+			// stop reading when the server shuts down
+			go func() {
+				<-req.Stopping()
+				c.SetReadDeadline(time.Unix(1, 0))
+			}()
+			for {
+				line, err := br.ReadString('\n')
+				if err != nil {
+					break
+				}
+				io.WriteString(c, line)
+			}
+			io.WriteString(c, "bye\n")
+		})
+	}))
+	srv := NewServer(0, p)
+	startTestServer(t, srv)
+
+	// data sent right after the request is buffered with it
+	c, br := testDial(t, srv)
+	defer c.Close()
+	io.WriteString(c, "GET / HTTP/1.1\r\nHost: test\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\nhello\n")
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("Could not read response: %v", err)
+	}
+	if res.StatusCode != 101 || res.Header.Get("Upgrade") != "echo" {
+		t.Fatalf("Got %v %v expected an upgrade to echo", res.StatusCode, res.Header)
+	}
+	if line, _ := br.ReadString('\n'); line != "hello\n" {
+		t.Errorf("Got %q expected hello", line)
+	}
+	io.WriteString(c, "again\n")
+	if line, _ := br.ReadString('\n'); line != "again\n" {
+		t.Errorf("Got %q expected again", line)
+	}
+	if n := srv.HijackedConnections(); n != 1 {
+		t.Errorf("HijackedConnections %v expected 1", n)
+	}
+
+	// shutdown waits for the handler to finish
+	done := make(chan error, 1)
+	go func() { done <- srv.Shutdown(context.Background()) }()
+	if line, _ := br.ReadString('\n'); line != "bye\n" {
+		t.Errorf("Got %q expected bye", line)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Shutdown error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Shutdown didn't finish")
+	}
+	if n := srv.HijackedConnections(); n != 0 {
+		t.Errorf("HijackedConnections %v expected 0", n)
+	}
+}
+
+func TestTrailers(t *testing.T) {
+	p := NewPipeline()
+	p.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		switch req.HttpRequest.URL.Path {
+		case "/simple":
+			res := SimpleResponse(req.HttpRequest, 200, nil, "body")
+			res.Trailer = http.Header{"X-Checksum": {"abc"}}
+			return res
+		case "/stream":
+			res := NewStreamResponse(req, 200, nil, func(w *StreamWriter) {
+				io.WriteString(w, "body")
+				w.Trailer().Set("X-Status", "done")
+			})
+			res.Trailer["X-Status"] = nil
+			return res
+		}
+		// echoes the request trailer once the body is read
+		io.ReadAll(req.HttpRequest.Body)
+		return SimpleResponse(req.HttpRequest, 200, nil, req.Trailer().Get("X-Sum"))
+	}))
+	srv := NewServer(0, p)
+	startTestServer(t, srv)
+	defer srv.Shutdown(context.Background())
+
+	c, br := testDial(t, srv)
+	defer c.Close()
+	tests := []struct {
+		request string
+		body    string
+		trailer string
+		value   string
+	}{
+		{"GET /simple HTTP/1.1\r\nHost: test\r\n\r\n", "body", "X-Checksum", "abc"},
+		{"GET /stream HTTP/1.1\r\nHost: test\r\n\r\n", "body", "X-Status", "done"},
+		{"POST /echo HTTP/1.1\r\nHost: test\r\nTransfer-Encoding: chunked\r\nTrailer: X-Sum\r\n\r\n" +
+			"4\r\ndata\r\n0\r\nX-Sum: 123\r\n\r\n", "123", "", ""},
+	}
+	for _, test := range tests {
+		io.WriteString(c, test.request)
+		res, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("Could not read response: %v", err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if string(body) != test.body {
+			t.Errorf("Body %q expected %q", body, test.body)
+		}
+		if test.trailer == "" {
+			continue
+		}
+		if _, declared := res.Trailer[test.trailer]; !declared {
+			t.Errorf("%v wasn't declared", test.trailer)
+		}
+		if v := res.Trailer.Get(test.trailer); v != test.value {
+			t.Errorf("Trailer %v = %q expected %q", test.trailer, v, test.value)
+		}
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	p := NewPipeline()
+	p.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		if req.HttpRequest.URL.Path == "/reject" {
+			return SimpleResponse(req.HttpRequest, 413, nil, "too big")
+		}
+		body, _ := io.ReadAll(req.HttpRequest.Body)
+		return SimpleResponse(req.HttpRequest, 200, nil, string(body))
+	}))
+	srv := NewServer(0, p)
+	startTestServer(t, srv)
+	defer srv.Shutdown(context.Background())
+
+	c, br := testDial(t, srv)
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// the body is only sent after the 100 Continue
+	io.WriteString(c, "POST /echo HTTP/1.1\r\nHost: test\r\nExpect: 100-continue\r\nContent-Length: 4\r\n\r\n")
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("Could not read response: %v", err)
+	}
+	if res.StatusCode != 100 {
+		t.Fatalf("Got %v expected 100 Continue", res.StatusCode)
+	}
+	io.WriteString(c, "data")
+	if res, err = http.ReadResponse(br, nil); err != nil {
+		t.Fatalf("Could not read response: %v", err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != 200 || string(body) != "data" || res.Close {
+		t.Errorf("Got %v %q close %v expected 200 data", res.StatusCode, body, res.Close)
+	}
+
+	// rejected without the body and the connection is closed
+	io.WriteString(c, "POST /reject HTTP/1.1\r\nHost: test\r\nExpect: 100-continue\r\nContent-Length: 4\r\n\r\n")
+	if res, err = http.ReadResponse(br, nil); err != nil {
+		t.Fatalf("Could not read response: %v", err)
+	}
+	body, _ = io.ReadAll(res.Body)
+	if res.StatusCode != 413 || string(body) != "too big" || !res.Close {
+		t.Errorf("Got %v %q close %v expected 413 and close", res.StatusCode, body, res.Close)
+	}
+	// sending the body late doesn't lose the response or get a reset
+	io.WriteString(c, "data")
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Errorf("Got %v expected EOF", err)
+	}
+}
+
+func TestSwapPipeline(t *testing.T) {
+	pipeline := func(body string, done chan string) *Pipeline {
+		p := NewPipeline()
+		p.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+			return SimpleResponse(req.HttpRequest, 200, nil, body)
+		}))
+		p.RequestDoneCallback = NewRequestFilter(func(req *Request) *http.Response {
+			done <- body
+			return nil
+		})
+		return p
+	}
+	done := make(chan string, 100)
+	one := pipeline("one", done)
+	srv := NewServer(0, one)
+	startTestServer(t, srv)
+	defer srv.Shutdown(context.Background())
+
+	get := func() string {
+		res, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/", srv.Port()))
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if cb := <-done; cb != string(body) {
+			t.Errorf("RequestDoneCallback from %q for a response from %q", cb, body)
+		}
+		return string(body)
+	}
+	if body := get(); body != "one" {
+		t.Errorf("Got %q expected one", body)
+	}
+
+	// swapping while requests run is safe
+	stop := make(chan int)
+	swapped := make(chan int)
+	go func() {
+		defer close(swapped)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			srv.SwapPipeline(pipeline(fmt.Sprint(i), done))
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		get()
+	}
+	close(stop)
+	<-swapped
+
+	two := pipeline("two", done)
+	srv.SwapPipeline(two)
+	if srv.CurrentPipeline() != two {
+		t.Errorf("CurrentPipeline isn't the swapped in pipeline")
+	}
+	if body := get(); body != "two" {
+		t.Errorf("Got %q expected two", body)
+	}
+}
@@ -2,14 +2,23 @@
 package falcore
 
 import (
+	"errors"
 	"net"
+	"syscall"
 )
 
 // only valid on non-windows
-func (srv *Server) setupNonBlockingListener(err error, l *net.TCPListener) error {
+func (srv *Server) setupNonBlockingListener(l *Listener) error {
 	return nil
 }
 
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return errors.New("ReusePort isn't supported on windows")
+}
+
+func closeOnExec(fd int) {
+}
+
 func (srv *Server) cycleNonBlock(c net.Conn) {
 	// nuthin
 }
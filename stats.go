@@ -0,0 +1,81 @@
+package falcore
+
+import (
+	"sync/atomic"
+)
+
+// A snapshot of the server's counters from Server.Stats.  Totals count
+// from when the server was created.
+//
+// There's no option to turn the counters off.  Each is an atomic add
+// per connection or request, which is lost in the cost of the syscalls
+// around it, and OpenConnections, HijackedConnections and
+// RejectedConnections are kept for their own getters anyway.
+type ServerStats struct {
+	// Connections accepted in total
+	AcceptedConnections int64
+	// Connections being handled now, including hijacked ones
+	OpenConnections int64
+	// Connections taken over by an UpgradeHandler now
+	HijackedConnections int64
+	// Connections handled and closed in total.  Rejected ones aren't
+	// included.
+	ClosedConnections int64
+	// Connections answered with a 503 by MaxConnections or
+	// MaxConnectionsPerIP
+	RejectedConnections int64
+	// Connections closed because of a timeout
+	TimedOutConnections int64
+	// Accept errors other than the accept loop's own timeouts
+	AcceptErrors int64
+	// Times the accept loop waited for MaxConnections
+	AcceptWaits int64
+
+	// Requests received in total, over HTTP/1 and HTTP/2
+	Requests int64
+	// Requests in the pipeline or being written now
+	ActiveRequests int64
+	// The average number of requests, or HTTP/2 streams, on closed
+	// connections
+	RequestsPerConnection float64
+
+	// Connections that reused a read buffer from the pool, that had to
+	// allocate one, and whose buffer was dropped because the pool was full
+	BufferPoolHits     int64
+	BufferPoolMisses   int64
+	BufferPoolDiscards int64
+}
+
+// The fraction of connections that reused a pooled buffer
+func (s *ServerStats) BufferPoolHitRate() float64 {
+	if total := s.BufferPoolHits + s.BufferPoolMisses; total > 0 {
+		return float64(s.BufferPoolHits) / float64(total)
+	}
+	return 0
+}
+
+// Returns the current counters.  Each one is read atomically but they
+// aren't read all at the same instant.
+func (srv *Server) Stats() *ServerStats {
+	s := &ServerStats{
+		AcceptedConnections: atomic.LoadInt64(&srv.acceptedConns),
+		OpenConnections:     atomic.LoadInt64(&srv.openConns),
+		HijackedConnections: atomic.LoadInt64(&srv.hijackedConns),
+		ClosedConnections:   atomic.LoadInt64(&srv.closedConns),
+		RejectedConnections: atomic.LoadInt64(&srv.rejectedConns),
+		TimedOutConnections: atomic.LoadInt64(&srv.timedOutConns),
+		AcceptErrors:        atomic.LoadInt64(&srv.acceptErrors),
+		AcceptWaits:         atomic.LoadInt64(&srv.acceptWaits),
+		Requests:            atomic.LoadInt64(&srv.requests),
+		ActiveRequests:      atomic.LoadInt64(&srv.activeRequests),
+	}
+	if s.ClosedConnections > 0 {
+		s.RequestsPerConnection = float64(atomic.LoadInt64(&srv.connRequests)) / float64(s.ClosedConnections)
+	}
+	if p := srv.bufferPool; p != nil {
+		s.BufferPoolHits = atomic.LoadInt64(&p.hits)
+		s.BufferPoolMisses = atomic.LoadInt64(&p.misses)
+		s.BufferPoolDiscards = atomic.LoadInt64(&p.discards)
+	}
+	return s
+}
@@ -0,0 +1,122 @@
+package falcore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	var active int64
+	p := NewPipeline()
+	srv := NewServer(0, p)
+	p.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		active = srv.Stats().ActiveRequests
+		return SimpleResponse(req.HttpRequest, 200, nil, "OK")
+	}))
+	startTestServer(t, srv)
+	defer srv.Shutdown(context.Background())
+
+	// two connections, one after the other, with 3 and 1 requests
+	for _, n := range []int{3, 1} {
+		c, br := testDial(t, srv)
+		for i := 0; i < n; i++ {
+			io.WriteString(c, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+			res, err := http.ReadResponse(br, nil)
+			if err != nil {
+				t.Fatalf("Could not read response: %v", err)
+			}
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+		}
+		c.Close()
+		for srv.OpenConnections() > 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	s := srv.Stats()
+	if active != 1 {
+		t.Errorf("ActiveRequests in the pipeline %v expected 1", active)
+	}
+	expected := []struct {
+		name      string
+		got, want int64
+	}{
+		{"AcceptedConnections", s.AcceptedConnections, 2},
+		{"ClosedConnections", s.ClosedConnections, 2},
+		{"OpenConnections", s.OpenConnections, 0},
+		{"Requests", s.Requests, 4},
+		{"ActiveRequests", s.ActiveRequests, 0},
+		{"BufferPoolHits", s.BufferPoolHits, 1},
+		{"BufferPoolMisses", s.BufferPoolMisses, 1},
+	}
+	for _, e := range expected {
+		if e.got != e.want {
+			t.Errorf("%v %v expected %v", e.name, e.got, e.want)
+		}
+	}
+	if s.RequestsPerConnection != 2 {
+		t.Errorf("RequestsPerConnection %v expected 2", s.RequestsPerConnection)
+	}
+	if s.BufferPoolHitRate() != 0.5 {
+		t.Errorf("BufferPoolHitRate %v expected 0.5", s.BufferPoolHitRate())
+	}
+}
+
+func TestStatsRejected(t *testing.T) {
+	srv := limitTestServer(t, func(srv *Server) { srv.MaxConnectionsPerIP = 1 })
+	defer srv.Shutdown(context.Background())
+
+	a, abr := testDial(t, srv)
+	if status, err := limitTestRequest(a, abr); status != 200 {
+		t.Fatalf("First connection got %v %v", status, err)
+	}
+	b, bbr := testDial(t, srv)
+	if status, err := limitTestRequest(b, bbr); status != 503 {
+		t.Errorf("Second connection got %v %v expected 503", status, err)
+	}
+	b.Close()
+	a.Close()
+	for srv.OpenConnections() > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the rejected connection doesn't count as closed
+	s := srv.Stats()
+	if s.RejectedConnections != 1 || s.ClosedConnections != 1 {
+		t.Errorf("RejectedConnections %v ClosedConnections %v expected 1 and 1", s.RejectedConnections, s.ClosedConnections)
+	}
+	if s.RequestsPerConnection != 1 {
+		t.Errorf("RequestsPerConnection %v expected 1", s.RequestsPerConnection)
+	}
+}
+
+func TestStatsHTTP2(t *testing.T) {
+	stages := make(chan []string, 3)
+	srv := NewServer(0, http2TestPipeline(stages))
+	srv.EnableH2C = true
+	startTestServer(t, srv)
+	defer srv.Shutdown(context.Background())
+
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	tr := &http.Transport{Protocols: protocols}
+	client := &http.Client{Transport: tr}
+	for i := 0; i < 3; i++ {
+		checkHTTP2Response(t, client, fmt.Sprintf("http://localhost:%d/", srv.Port()), stages)
+	}
+	tr.CloseIdleConnections()
+	for srv.OpenConnections() > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// each stream counts as a request on the one connection
+	s := srv.Stats()
+	if s.ClosedConnections != 1 || s.RequestsPerConnection != 3 {
+		t.Errorf("ClosedConnections %v RequestsPerConnection %v expected 1 and 3", s.ClosedConnections, s.RequestsPerConnection)
+	}
+}
@@ -0,0 +1,210 @@
+package falcore
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Writes the body of a streamed response.  Data is sent in chunks as
+// it's written and Flush pushes it to the client right away, even with
+// TCP_CORK or TCP_NOPUSH on the socket.
+type StreamWriter struct {
+	w       io.Writer
+	flush   func() error
+	err     error
+	trailer http.Header
+}
+
+// Writes to the body.  After an error the client is gone and every
+// later write returns the same error.
+func (sw *StreamWriter) Write(p []byte) (int, error) {
+	if sw.err != nil {
+		return 0, sw.err
+	}
+	n, err := sw.w.Write(p)
+	sw.err = err
+	return n, err
+}
+
+// The response's trailer fields, sent after the body.  Set values in it
+// before the stream function returns.  Names should be declared ahead of
+// time in http.Response.Trailer, and clients that don't support chunked
+// encoding, ie HTTP/1.0, don't get trailers.
+func (sw *StreamWriter) Trailer() http.Header {
+	return sw.trailer
+}
+
+// Sends everything written so far to the client
+func (sw *StreamWriter) Flush() error {
+	if sw.err != nil {
+		return sw.err
+	}
+	sw.err = sw.flush()
+	return sw.err
+}
+
+// Creates a response with a body written by stream.  stream is called
+// by the server once the headers are written and the response is done
+// when it returns.  It should give up when the client goes away, ie when
+// a write fails or req.Ctx() is done, and when req.Stopping() is closed.
+//
+//    return falcore.NewStreamResponse(req, 200, nil, func(w *falcore.StreamWriter) {
+//        for msg := range updates {
+//            fmt.Fprintln(w, msg)
+//            if w.Flush() != nil {
+//                return
+//            }
+//        }
+//    })
+//
+// Response filters that read the body see the whole stream at once.
+func NewStreamResponse(req *Request, status int, headers http.Header, stream func(w *StreamWriter)) *http.Response {
+	res := SimpleResponse(req.HttpRequest, status, headers, "")
+	res.ContentLength = -1
+	res.Trailer = make(http.Header)
+	res.Body = &streamBody{stream: stream, trailer: res.Trailer}
+	return res
+}
+
+type streamBody struct {
+	stream  func(w *StreamWriter)
+	trailer http.Header
+	once    sync.Once
+	pr      *io.PipeReader
+}
+
+// Reading the body runs the stream into a pipe, for filters that replace it
+func (b *streamBody) Read(p []byte) (int, error) {
+	b.once.Do(func() {
+		var pw *io.PipeWriter
+		b.pr, pw = io.Pipe()
+		go func() {
+			b.stream(&StreamWriter{w: pw, flush: func() error { return nil }, trailer: b.trailer})
+			pw.Close()
+		}()
+	})
+	if b.pr == nil {
+		// already written or closed
+		return 0, io.EOF
+	}
+	return b.pr.Read(p)
+}
+
+func (b *streamBody) Close() error {
+	b.once.Do(func() {})
+	if b.pr != nil {
+		b.pr.Close()
+	}
+	return nil
+}
+
+// Returns the body if it still has to be streamed
+func streamResponseBody(res *http.Response) *streamBody {
+	if sb, ok := res.Body.(*streamBody); ok && sb.pr == nil {
+		return sb
+	}
+	return nil
+}
+
+// Writes a streamed response to the connection.  Every flush and write
+// gets WriteTimeout, rather than the whole response.  HEAD requests and
+// statuses that can't have a body only get the headers and the stream
+// isn't run.
+func (srv *Server) writeStream(c net.Conn, req *http.Request, res *http.Response, sb *streamBody) error {
+	sb.once.Do(func() {})
+	touch := func() {
+		if srv.WriteTimeout > 0 {
+			c.SetWriteDeadline(time.Now().Add(srv.WriteTimeout))
+		}
+	}
+	touch()
+	bw := bufio.NewWriter(c)
+	allowed := bodyAllowedForStatus(res.StatusCode)
+	chunked := allowed && len(res.TransferEncoding) > 0 && res.TransferEncoding[0] == "chunked"
+	writeResponseHeader(bw, res, chunked)
+	if req.Method == "HEAD" || !allowed {
+		err := bw.Flush()
+		srv.cycleNonBlock(c)
+		return err
+	}
+
+	if res.Trailer == nil {
+		res.Trailer = sb.trailer
+	}
+	sw := &StreamWriter{w: bw, trailer: res.Trailer}
+	var cw io.WriteCloser
+	if chunked {
+		cw = httputil.NewChunkedWriter(bw)
+		sw.w = cw
+	}
+	sw.flush = func() error {
+		touch()
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+		srv.cycleNonBlock(c)
+		return nil
+	}
+	sb.stream(sw)
+	if sw.err != nil {
+		return sw.err
+	}
+
+	touch()
+	if chunked {
+		cw.Close()
+		res.Trailer.Write(bw)
+		bw.WriteString("\r\n")
+	}
+	err := bw.Flush()
+	srv.cycleNonBlock(c)
+	return err
+}
+
+// Writes the status line and headers like http.Response.Write, for
+// responses the server writes itself
+func writeResponseHeader(w *bufio.Writer, res *http.Response, chunked bool) {
+	text := res.Status
+	if text == "" {
+		if text = http.StatusText(res.StatusCode); text == "" {
+			text = "status code " + strconv.Itoa(res.StatusCode)
+		}
+	} else {
+		text = strings.TrimPrefix(text, strconv.Itoa(res.StatusCode)+" ")
+	}
+	fmt.Fprintf(w, "HTTP/%d.%d %03d %s\r\n", res.ProtoMajor, res.ProtoMinor, res.StatusCode, text)
+	res.Header.Write(w)
+	if chunked {
+		w.WriteString("Transfer-Encoding: chunked\r\n")
+		if names := trailerNames(res.Trailer); names != "" {
+			w.WriteString("Trailer: " + names + "\r\n")
+		}
+	}
+	if res.Close && !headerHasToken(res.Header, "Connection", "close") {
+		w.WriteString("Connection: close\r\n")
+	}
+	w.WriteString("\r\n")
+}
+
+// The declared trailer names for the Trailer header
+func trailerNames(trailer http.Header) string {
+	names := make([]string, 0, len(trailer))
+	for k := range trailer {
+		switch k {
+		case "Transfer-Encoding", "Trailer", "Content-Length":
+		default:
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
@@ -0,0 +1,186 @@
+package falcore
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamResponse(t *testing.T) {
+	next := make(chan int)
+	p := NewPipeline()
+	p.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		return NewStreamResponse(req, 200, nil, func(w *StreamWriter) {
+			io.WriteString(w, "one\n")
+			w.Flush()
+			// the client has to see the first line before the second is written
+			<-next
+			io.WriteString(w, "two\n")
+		})
+	}))
+	srv := NewServer(0, p)
+	startTestServer(t, srv)
+	defer srv.Shutdown(context.Background())
+
+	for _, sendfile := range []bool{true, false} {
+		srv.sendfile = sendfile
+		c, br := testDial(t, srv)
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		// the connection is reused after the stream
+		for i := 0; i < 2; i++ {
+			io.WriteString(c, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+			res, err := http.ReadResponse(br, nil)
+			if err != nil {
+				t.Fatalf("Could not read response: %v", err)
+			}
+			if len(res.TransferEncoding) == 0 || res.TransferEncoding[0] != "chunked" {
+				t.Errorf("Transfer-Encoding %v expected chunked", res.TransferEncoding)
+			}
+			body := bufio.NewReader(res.Body)
+			if line, err := body.ReadString('\n'); line != "one\n" {
+				t.Fatalf("sendfile %v got %q %v expected one", sendfile, line, err)
+			}
+			next <- 1
+			if rest, _ := io.ReadAll(body); string(rest) != "two\n" {
+				t.Errorf("Got %q expected two", rest)
+			}
+			res.Body.Close()
+		}
+		c.Close()
+	}
+}
+
+func TestStreamResponseRead(t *testing.T) {
+	// a response filter that reads the whole body
+	p := NewPipeline()
+	p.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		return NewStreamResponse(req, 200, nil, func(w *StreamWriter) {
+			io.WriteString(w, "one ")
+			w.Flush()
+			io.WriteString(w, "two")
+		})
+	}))
+	p.Downstream.PushBack(NewResponseFilter(func(req *Request, res *http.Response) {
+		b, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		res.Body = io.NopCloser(strings.NewReader(strings.ToUpper(string(b))))
+	}))
+	srv := NewServer(0, p)
+	startTestServer(t, srv)
+	defer srv.Shutdown(context.Background())
+
+	c, br := testDial(t, srv)
+	defer c.Close()
+	io.WriteString(c, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("Could not read response: %v", err)
+	}
+	if body, _ := io.ReadAll(res.Body); string(body) != "ONE TWO" {
+		t.Errorf("Got %q expected ONE TWO", body)
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	p := NewPipeline()
+	p.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		return NewEventStreamResponse(req, 50*time.Millisecond, func(es *EventStream) {
+			es.Send(&Event{ID: es.LastEventID() + "1", Event: "update", Data: "a\nb"})
+			es.Send(&Event{Data: "c", Retry: time.Second})
+			// long enough for a heartbeat
+			time.Sleep(150 * time.Millisecond)
+		})
+	}))
+	srv := NewServer(0, p)
+	startTestServer(t, srv)
+	defer srv.Shutdown(context.Background())
+
+	c, br := testDial(t, srv)
+	defer c.Close()
+	io.WriteString(c, "GET / HTTP/1.1\r\nHost: test\r\nLast-Event-ID: 4\r\n\r\n")
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("Could not read response: %v", err)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type %q", ct)
+	}
+	body, _ := io.ReadAll(res.Body)
+	expected := "id: 41\nevent: update\ndata: a\ndata: b\n\nretry: 1000\ndata: c\n\n: heartbeat\n\n"
+	if !strings.HasPrefix(string(body), expected) {
+		t.Errorf("Got %q expected %q", body, expected)
+	}
+}
+
+func TestStreamResponseNoBody(t *testing.T) {
+	streamed := make(chan string, 10)
+	p := NewPipeline()
+	p.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		switch req.HttpRequest.URL.Path {
+		case "/stream":
+			return NewStreamResponse(req, 200, nil, func(w *StreamWriter) {
+				streamed <- "stream"
+				io.WriteString(w, "hello")
+			})
+		case "/events":
+			return NewEventStreamResponse(req, 0, func(es *EventStream) {
+				streamed <- "events"
+				es.Send(&Event{Data: "hello"})
+			})
+		case "/nocontent":
+			return NewStreamResponse(req, 204, nil, func(w *StreamWriter) {
+				streamed <- "nocontent"
+				io.WriteString(w, "hello")
+			})
+		}
+		return okFilter(req)
+	}))
+	srv := NewServer(0, p)
+	startTestServer(t, srv)
+	defer srv.Shutdown(context.Background())
+
+	c, br := testDial(t, srv)
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	// a body after any of these would be read as the next response
+	for _, test := range []struct {
+		method string
+		path   string
+		status int
+	}{
+		{"HEAD", "/stream", 200},
+		{"HEAD", "/events", 200},
+		{"GET", "/nocontent", 204},
+	} {
+		io.WriteString(c, test.method+" "+test.path+" HTTP/1.1\r\nHost: test\r\n\r\n")
+		res, err := http.ReadResponse(br, &http.Request{Method: test.method})
+		if err != nil {
+			t.Fatalf("Could not read response: %v", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != test.status {
+			t.Errorf("%v %v got %v expected %v", test.method, test.path, res.StatusCode, test.status)
+		}
+		if test.status == 204 && len(res.TransferEncoding) > 0 {
+			t.Errorf("204 sent Transfer-Encoding %v", res.TransferEncoding)
+		}
+
+		io.WriteString(c, "GET /plain HTTP/1.1\r\nHost: test\r\n\r\n")
+		if res, err = http.ReadResponse(br, nil); err != nil {
+			t.Fatalf("Could not read response after %v %v: %v", test.method, test.path, err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		if res.StatusCode != 200 || string(body) != "OK" {
+			t.Errorf("After %v %v got %v %q expected 200 OK", test.method, test.path, res.StatusCode, body)
+		}
+	}
+	select {
+	case name := <-streamed:
+		t.Errorf("The %v stream ran without a body to write", name)
+	default:
+	}
+}
@@ -0,0 +1,116 @@
+package falcore
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// The first socket passed by systemd socket activation
+var systemdFdStart = 3
+
+// Returns the sockets passed by systemd socket activation as listeners
+// named by FileDescriptorName= in the socket unit.  The listeners aren't
+// opened yet.  The LISTEN_ variables are cleared so processes started from
+// this one don't try to use the sockets.  Returns nil if the process
+// wasn't socket activated.
+func SystemdListeners() ([]*Listener, error) {
+	pid := os.Getenv("LISTEN_PID")
+	fds := os.Getenv("LISTEN_FDS")
+	names := os.Getenv("LISTEN_FDNAMES")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, errors.New("Invalid LISTEN_FDS: " + fds)
+	}
+	var nameList []string
+	if names != "" {
+		nameList = strings.Split(names, ":")
+	}
+	listeners := make([]*Listener, n)
+	for i := range listeners {
+		fd := systemdFdStart + i
+		closeOnExec(fd)
+		name := ""
+		if i < len(nameList) {
+			name = nameList[i]
+		}
+		listeners[i] = &Listener{Name: name, File: os.NewFile(uintptr(fd), name)}
+	}
+	return listeners, nil
+}
+
+// Serves on the sockets passed by systemd socket activation.  Each socket
+// is given to the listener with the same name so its TLSConfig and other
+// settings apply.  Sockets without a matching listener are served as plain
+// listeners and listeners without a socket are opened as usual.  If a
+// single socket is passed and no listeners are given it becomes the
+// default listener, like FdListen.  Returns the number of sockets passed.
+func (srv *Server) SystemdListen(listeners ...*Listener) (int, error) {
+	activated, err := SystemdListeners()
+	if err != nil {
+		return 0, err
+	}
+	if len(activated) == 1 && len(listeners) == 0 {
+		return 1, srv.setDefaultListener(activated[0])
+	}
+	byName := make(map[string]*Listener)
+	for _, l := range listeners {
+		if l.Name != "" && l.File == nil {
+			byName[l.Name] = l
+		}
+	}
+	for _, a := range activated {
+		if l, ok := byName[a.Name]; ok {
+			l.File = a.File
+			delete(byName, a.Name)
+		} else {
+			listeners = append(listeners, a)
+		}
+	}
+	for _, l := range listeners {
+		if err := srv.AddListener(l); err != nil {
+			return len(activated), err
+		}
+	}
+	return len(activated), nil
+}
+
+// Sends a state like "READY=1" to the systemd service manager.  Does
+// nothing if NOTIFY_SOCKET isn't set.  The Server sends READY=1 once it's
+// accepting and STOPPING=1 when it stops, unless it's handed off.
+func SystemdNotify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	// a leading @ is an abstract socket, which net handles
+	c, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	_, err = c.Write([]byte(state))
+	return err
+}
+
+// Tells the server another process has taken over the service, ie after
+// a hot restart, so it drains without sending STOPPING=1.  systemd would
+// otherwise stop the unit, new main process and all.
+func (srv *Server) HandOff() {
+	atomic.StoreInt32(&srv.handedOff, 1)
+}
+
+func (srv *Server) systemdNotify(state string) {
+	if err := SystemdNotify(state); err != nil {
+		Warn("%s SERVER systemd notify %s failed: %v", srv.serverLogPrefix(), state, err)
+	}
+}
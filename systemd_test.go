@@ -0,0 +1,155 @@
+// +build linux
+
+package falcore
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Puts copies of the listeners' sockets where systemd would and sets the
+// LISTEN_ variables.  High fds are used so nothing the test process
+// already has open is clobbered.
+func fakeSocketActivation(t *testing.T, names string, listeners ...*net.TCPListener) {
+	systemdFdStart = 100
+	t.Cleanup(func() { systemdFdStart = 3 })
+	for i, tl := range listeners {
+		f, err := tl.File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = syscall.Dup3(int(f.Fd()), systemdFdStart+i, 0); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		tl.Close()
+	}
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", strconv.Itoa(len(listeners)))
+	t.Setenv("LISTEN_FDNAMES", names)
+}
+
+func testListenTCP(t *testing.T) *net.TCPListener {
+	tl, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tl
+}
+
+func TestSystemdListen(t *testing.T) {
+	a, b := testListenTCP(t), testListenTCP(t)
+	addrA, addrB := a.Addr().String(), b.Addr().String()
+	fakeSocketActivation(t, "http:admin", a, b)
+
+	p := NewPipeline()
+	p.Upstream.PushBack(NewRequestFilter(okFilter))
+	srv := NewServer(0, p)
+	web := &Listener{Name: "http"}
+	n, err := srv.SystemdListen(web)
+	if err != nil {
+		t.Fatalf("SystemdListen failed: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("Got %v sockets expected 2", n)
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Errorf("LISTEN_FDS wasn't cleared")
+	}
+	listeners := srv.Listeners()
+	if len(listeners) != 2 || listeners[0] != web || listeners[1].Name != "admin" {
+		t.Fatalf("Unexpected listeners: %v", listeners)
+	}
+
+	go srv.Serve()
+	<-srv.AcceptReady
+	defer srv.Shutdown(context.Background())
+	for _, addr := range []string{addrA, addrB} {
+		res, err := testGet("http://" + addr + "/")
+		if err != nil || res != "OK" {
+			t.Errorf("Request to %v: %q %v", addr, res, err)
+		}
+	}
+}
+
+func TestSystemdListenDefault(t *testing.T) {
+	fakeSocketActivation(t, "", testListenTCP(t))
+	srv := NewServer(0, NewPipeline())
+	if n, err := srv.SystemdListen(); n != 1 || err != nil {
+		t.Fatalf("SystemdListen: %v %v", n, err)
+	}
+	if srv.SocketFd() < 0 {
+		t.Errorf("Socket wasn't used as the default listener")
+	}
+	srv.StopAccepting()
+}
+
+// Listens where NOTIFY_SOCKET points and returns a function that reads
+// the next notification, or "" if there isn't one within wait
+func fakeNotifySocket(t *testing.T) func(wait time.Duration) string {
+	path := filepath.Join(t.TempDir(), "notify")
+	notify, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { notify.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+	return func(wait time.Duration) string {
+		notify.SetReadDeadline(time.Now().Add(wait))
+		b := make([]byte, 256)
+		n, _ := notify.Read(b)
+		return string(b[:n])
+	}
+}
+
+func TestSystemdNotify(t *testing.T) {
+	next := fakeNotifySocket(t)
+	srv := NewServer(0, NewPipeline())
+	errc := startTestServer(t, srv)
+	if s := next(5 * time.Second); s != "READY=1" {
+		t.Errorf("Got %q expected READY=1", s)
+	}
+	srv.Shutdown(context.Background())
+	if s := next(5 * time.Second); s != "STOPPING=1" {
+		t.Errorf("Got %q expected STOPPING=1", s)
+	}
+	<-errc
+}
+
+func TestSystemdNotifyHandOff(t *testing.T) {
+	next := fakeNotifySocket(t)
+	srv := NewServer(0, NewPipeline())
+	errc := startTestServer(t, srv)
+	if s := next(5 * time.Second); s != "READY=1" {
+		t.Errorf("Got %q expected READY=1", s)
+	}
+	// what the restart Manager does once the new process is ready
+	SystemdNotify("MAINPID=1234")
+	srv.HandOff()
+	srv.Shutdown(context.Background())
+	<-errc
+	if s := next(5 * time.Second); s != "MAINPID=1234" {
+		t.Errorf("Got %q expected MAINPID=1234", s)
+	}
+	if s := next(100 * time.Millisecond); s != "" {
+		t.Errorf("Handed off server sent %q", s)
+	}
+}
+
+func testGet(url string) (string, error) {
+	res, err := http.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	return string(b), err
+}
@@ -0,0 +1,89 @@
+package falcore
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"time"
+)
+
+// Options applied to a unix domain socket after it's created.
+// Zero values leave the defaults alone.
+type UnixSocketOptions struct {
+	// File permissions for the socket, ie 0660
+	Mode os.FileMode
+	// User and group names or numeric ids to own the socket
+	User  string
+	Group string
+}
+
+func (l *Listener) unixListen(srv *Server) error {
+	if err := removeStaleSocket(l.Addr); err != nil {
+		return err
+	}
+	ul, err := net.ListenUnix("unix", &net.UnixAddr{Name: l.Addr, Net: "unix"})
+	if err != nil {
+		return err
+	}
+	// a hot restarted child keeps serving on this socket
+	// so it can't be removed when we stop listening
+	ul.SetUnlinkOnClose(false)
+	if err = l.UnixSocket.apply(l.Addr); err != nil {
+		ul.Close()
+		return err
+	}
+	l.raw = ul
+	return srv.setupNonBlockingListener(l)
+}
+
+// Removes a socket file left behind by a server that's gone.  It's an
+// error if something is still listening on it.
+func removeStaleSocket(path string) error {
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return errors.New("Unix socket path exists and isn't a socket: " + path)
+	}
+	if c, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		c.Close()
+		return errors.New("Unix socket is in use: " + path)
+	}
+	return os.Remove(path)
+}
+
+func (o UnixSocketOptions) apply(path string) error {
+	if o.Mode != 0 {
+		if err := os.Chmod(path, o.Mode); err != nil {
+			return err
+		}
+	}
+	if o.User == "" && o.Group == "" {
+		return nil
+	}
+	uid, gid := -1, -1
+	if o.User != "" {
+		u, err := user.Lookup(o.User)
+		if err != nil {
+			if u, err = user.LookupId(o.User); err != nil {
+				return err
+			}
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+	if o.Group != "" {
+		g, err := user.LookupGroup(o.Group)
+		if err != nil {
+			if g, err = user.LookupGroupId(o.Group); err != nil {
+				return err
+			}
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	return os.Chown(path, uid, gid)
+}
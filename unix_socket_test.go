@@ -0,0 +1,75 @@
+// +build !windows
+
+package falcore
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "falcore.sock")
+	p := NewPipeline()
+	p.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		return SimpleResponse(req.HttpRequest, 200, nil, req.RemoteNetAddr.Network())
+	}))
+
+	// leave a stale socket file behind
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatalf("Could not create stale socket: %v", err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	srv := NewUnixServer(path, p)
+	srv.UnixSocket.Mode = 0600
+	startTestServer(t, srv)
+	defer srv.Shutdown(context.Background())
+
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("Unix socket mode wrong: %v %v", fi, err)
+	}
+	// a live socket can't be taken over
+	if err := NewUnixServer(path, p).socketListen(); err == nil {
+		t.Errorf("Expected error listening on a socket in use")
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("unix", path)
+		},
+	}}
+	res, err := client.Get("http://falcore/")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "unix" {
+		t.Errorf("Remote address network: %q expected %q", body, "unix")
+	}
+
+	// hand the socket to another server like hot restart does
+	fd, err := syscall.Dup(srv.SocketFd())
+	if err != nil {
+		t.Fatalf("Could not dup socket: %v", err)
+	}
+	srv2 := NewServer(0, p)
+	if err := srv2.FdListen(fd); err != nil {
+		t.Fatalf("FdListen failed: %v", err)
+	}
+	srv2.listeners[0].close()
+	if srv2.Network != "unix" {
+		t.Errorf("FdListen network: %v expected unix", srv2.Network)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("Socket file removed by closing a passed listener: %v", err)
+	}
+}
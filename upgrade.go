@@ -0,0 +1,84 @@
+package falcore
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Takes over a connection after a 101 Switching Protocols response.
+// br holds anything the client sent after the request so it has to be
+// read before c.  The connection is closed when the handler returns.
+//
+// The server keeps the connection open through a graceful shutdown until
+// the handler returns.  It should watch Request.Stopping() and wrap up
+// when the server starts shutting down.
+type UpgradeHandler func(c net.Conn, br *bufio.Reader)
+
+// Creates a 101 Switching Protocols response that hands the connection to
+// handler once it's been written.  Response filters can still add headers.
+//
+//    if req.HttpRequest.Header.Get("Upgrade") == "echo" {
+//        return falcore.NewUpgradeResponse(req, "echo", func(c net.Conn, br *bufio.Reader) {
+//            io.Copy(c, br)
+//        })
+//    }
+func NewUpgradeResponse(req *Request, protocol string, handler UpgradeHandler) *http.Response {
+	res := SimpleResponse(req.HttpRequest, 101, nil, "")
+	res.Header.Set("Connection", "Upgrade")
+	res.Header.Set("Upgrade", protocol)
+	res.ContentLength = 0
+	res.Body = &upgradeBody{handler}
+	return res
+}
+
+// Marks an upgrade response and carries its handler
+type upgradeBody struct {
+	handler UpgradeHandler
+}
+
+func (b *upgradeBody) Read(p []byte) (int, error) {
+	return 0, nil
+}
+
+func (b *upgradeBody) Close() error {
+	return nil
+}
+
+// Returns the upgrade handler if res is an upgrade response
+func upgradeHandler(res *http.Response) UpgradeHandler {
+	if ub, ok := res.Body.(*upgradeBody); ok && res.StatusCode == 101 {
+		return ub.handler
+	}
+	return nil
+}
+
+// Writes the 101 response and runs the handler.  The request is finished
+// first so its stats don't include the life of the connection.
+func (srv *Server) upgradeConn(c net.Conn, br *bufio.Reader, request *Request, res *http.Response, handler UpgradeHandler) {
+	if srv.WriteTimeout > 0 {
+		c.SetWriteDeadline(time.Now().Add(srv.WriteTimeout))
+	}
+	// http.Response.Write adds framing headers a 101 can't have
+	w := bufio.NewWriter(c)
+	writeResponseHeader(w, res, false)
+	err := w.Flush()
+	srv.finishRequest(request, res)
+	if err != nil {
+		Debug("%s %v Upgrade response write error: %v", srv.serverLogPrefix(), c.RemoteAddr(), err)
+		return
+	}
+
+	c.SetDeadline(time.Time{})
+	srv.setConnState(c, StateHijacked, time.Time{})
+	atomic.AddInt64(&srv.hijackedConns, 1)
+	defer atomic.AddInt64(&srv.hijackedConns, -1)
+	handler(c, br)
+}
+
+// The number of connections currently taken over by an UpgradeHandler
+func (srv *Server) HijackedConnections() int64 {
+	return atomic.LoadInt64(&srv.hijackedConns)
+}
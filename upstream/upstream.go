@@ -2,6 +2,7 @@ package upstream
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"github.com/ngmoco/falcore"
 	"io"
@@ -75,16 +76,23 @@ func NewUpstream(host string, port int, forceHttp bool) *Upstream {
 	u.host = fmt.Sprintf("%v:%v", u.Host, u.Port)
 
 	u.transport = &http.Transport{}
-	// This dial ignores the addr passed in and dials based on the upstream host and port
-	u.transport.Dial = func(n, addr string) (c net.Conn, err error) {
+	// This dial ignores the addr passed in and dials based on the upstream host and port.
+	// The context is the request's so the dial gives up if the client does.
+	u.transport.DialContext = func(ctx context.Context, n, addr string) (c net.Conn, err error) {
 		falcore.Fine("Dialing connection to %v", u.tcpaddr)
-		var ctcp *net.TCPConn
-		ctcp, err = net.DialTCP("tcp4", nil, u.tcpaddr)
+		if u.tcpaddr == nil {
+			err = fmt.Errorf("No address for upstream %v", u.host)
+			falcore.Error("Dial Failed: %v", err)
+			return
+		}
+		var nc net.Conn
+		var d net.Dialer
+		nc, err = d.DialContext(ctx, "tcp4", u.tcpaddr.String())
 		if err != nil {
 			falcore.Error("Dial Failed: %v", err)
 			return
 		}
-		c = &connWrapper{conn: ctcp, timeout: u.Timeout}
+		c = &connWrapper{conn: nc, timeout: u.Timeout}
 		return
 	}
 	u.transport.MaxIdleConnsPerHost = 15
@@ -96,6 +104,9 @@ func (u *Upstream) SetPoolSize(size int) {
 	u.transport.MaxIdleConnsPerHost = size
 }
 
+// Proxies the request to the upstream.  The upstream request is canceled
+// along with the request's context, ie when the client hangs up or a
+// deadline passes.
 func (u *Upstream) FilterRequest(request *falcore.Request) (res *http.Response) {
 	var err error
 	req := request.HttpRequest
@@ -135,6 +146,8 @@ func (u *Upstream) FilterRequest(request *falcore.Request) (res *http.Response)
 			res.Body = upstrRes.Body
 			res.ContentLength = -1
 			res.TransferEncoding = []string{"chunked"}
+			// filled in as the body is read to the end
+			res.Trailer = upstrRes.Trailer
 		}
 		// Copy over headers with a few exceptions
 		res.Header = make(http.Header)
@@ -148,7 +161,13 @@ func (u *Upstream) FilterRequest(request *falcore.Request) (res *http.Response)
 			}
 		}
 	} else {
-		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		ctxErr := req.Context().Err()
+		if ctxErr == context.Canceled {
+			// nobody is going to see the response
+			falcore.Warn("%s Upstream request canceled: %v", request.ID, err)
+			res = falcore.SimpleResponse(req, 502, nil, "Bad Gateway\n")
+			request.CurrentStage.Status = 2 // Fail
+		} else if nerr, ok := err.(net.Error); ctxErr == context.DeadlineExceeded || (ok && nerr.Timeout()) {
 			falcore.Error("%s Upstream Timeout error: %v", request.ID, err)
 			res = falcore.SimpleResponse(req, 504, nil, "Gateway Timeout\n")
 			request.CurrentStage.Status = 2 // Fail
@@ -0,0 +1,46 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"sync"
+)
+
+// permessage-deflate messages are sync flushed with the last 4 bytes of
+// the flush removed.  An empty final block is added back after them so
+// the reader sees a clean EOF.
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+var errTooBig = errors.New("Message too big")
+
+var flateWriters sync.Pool
+
+func deflate(data []byte) []byte {
+	var buf bytes.Buffer
+	w, _ := flateWriters.Get().(*flate.Writer)
+	if w == nil {
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	} else {
+		w.Reset(&buf)
+	}
+	w.Write(data)
+	w.Flush()
+	flateWriters.Put(w)
+	return bytes.TrimSuffix(buf.Bytes(), deflateTail[:4])
+}
+
+// Decompresses a message of up to limit bytes
+func inflate(data []byte, limit int64) ([]byte, error) {
+	r := flate.NewReader(io.MultiReader(bytes.NewReader(data), bytes.NewReader(deflateTail)))
+	defer r.Close()
+	b, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > limit {
+		return nil, errTooBig
+	}
+	return b, nil
+}
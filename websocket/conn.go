@@ -0,0 +1,477 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Message types
+const (
+	TextMessage   = 1
+	BinaryMessage = 2
+)
+
+// Frame opcodes
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+// Close codes from RFC 6455 section 7.4.1
+const (
+	CloseNormalClosure      = 1000
+	CloseGoingAway          = 1001
+	CloseProtocolError      = 1002
+	CloseUnsupportedData    = 1003
+	CloseNoStatusReceived   = 1005
+	CloseAbnormalClosure    = 1006
+	CloseInvalidPayload     = 1007
+	ClosePolicyViolation    = 1008
+	CloseMessageTooBig      = 1009
+	CloseMandatoryExtension = 1010
+	CloseInternalError      = 1011
+)
+
+// Returned by ReadMessage when the connection was closed with a close
+// frame, either by the client or because the client broke the protocol.
+// Code is CloseNoStatusReceived if the client's close frame was empty.
+type CloseError struct {
+	Code int
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	if e.Text == "" {
+		return "WebSocket closed: " + strconv.Itoa(e.Code)
+	}
+	return "WebSocket closed: " + strconv.Itoa(e.Code) + " " + e.Text
+}
+
+// Returned when writing after a close frame was sent
+var ErrClosed = errors.New("WebSocket connection closed")
+
+// Messages this short aren't worth compressing
+const minCompressSize = 64
+
+// A WebSocket connection.  ReadMessage should only be called from one
+// goroutine at a time.  The write methods can be called from any
+// goroutine.
+type Conn struct {
+	c            net.Conn
+	br           *bufio.Reader
+	protocol     string
+	compress     bool
+	maxSize      int64
+	fragmentSize int
+	pingInterval time.Duration
+	writeTimeout time.Duration
+	closeTimeout time.Duration
+
+	// held while reading so Close can wait for a reader to finish
+	readMu        sync.Mutex
+	readErr       error
+	closeReceived bool
+
+	// held while writing a frame
+	wmu       sync.Mutex
+	closeSent bool
+
+	mu            sync.Mutex
+	closeDeadline time.Time
+}
+
+func newConn(c net.Conn, br *bufio.Reader, f *Filter, protocol string, compress bool) *Conn {
+	conn := &Conn{
+		c:            c,
+		br:           br,
+		protocol:     protocol,
+		compress:     compress,
+		maxSize:      f.MaxMessageSize,
+		fragmentSize: f.FragmentSize,
+		pingInterval: f.PingInterval,
+		writeTimeout: f.WriteTimeout,
+		closeTimeout: f.CloseTimeout,
+	}
+	if conn.maxSize <= 0 {
+		conn.maxSize = 1 << 20
+	}
+	if conn.closeTimeout <= 0 {
+		conn.closeTimeout = 5 * time.Second
+	}
+	return conn
+}
+
+// The subprotocol chosen from Filter.Protocols or "" if there wasn't one
+func (conn *Conn) Subprotocol() string {
+	return conn.protocol
+}
+
+// Reports whether permessage-deflate was negotiated
+func (conn *Conn) Compressed() bool {
+	return conn.compress
+}
+
+func (conn *Conn) RemoteAddr() net.Addr {
+	return conn.c.RemoteAddr()
+}
+
+func (conn *Conn) LocalAddr() net.Addr {
+	return conn.c.LocalAddr()
+}
+
+// Reads the next text or binary message.  Pings are answered and
+// fragmented messages are put back together.  Once it returns an error
+// every later call returns the same error.
+func (conn *Conn) ReadMessage() (messageType int, data []byte, err error) {
+	conn.readMu.Lock()
+	defer conn.readMu.Unlock()
+	if conn.readErr != nil {
+		return 0, nil, conn.readErr
+	}
+	messageType, data, err = conn.readMessage()
+	if err != nil {
+		conn.readErr = err
+		if ce, ok := err.(*CloseError); ok {
+			// answers the client's close or reports our own error
+			code := ce.Code
+			if code == CloseNoStatusReceived {
+				code = 0
+			}
+			conn.writeClose(code, ce.Text)
+		}
+	}
+	return
+}
+
+type frame struct {
+	fin     bool
+	rsv1    bool
+	op      byte
+	payload []byte
+}
+
+func protocolError(text string) error {
+	return &CloseError{Code: CloseProtocolError, Text: text}
+}
+
+func (conn *Conn) readMessage() (int, []byte, error) {
+	var messageType int
+	var compressed bool
+	var data []byte
+	for {
+		fr, err := conn.readFrame(int64(len(data)))
+		if err != nil {
+			return 0, nil, err
+		}
+		switch fr.op {
+		case opPing:
+			if err := conn.writeControl(opPong, fr.payload); err != nil && err != ErrClosed {
+				return 0, nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			conn.closeReceived = true
+			return 0, nil, readCloseFrame(fr.payload)
+		case opText, opBinary:
+			if messageType != 0 {
+				return 0, nil, protocolError("Expected a continuation frame")
+			}
+			messageType = int(fr.op)
+			compressed = fr.rsv1
+		case opContinuation:
+			if messageType == 0 {
+				return 0, nil, protocolError("Unexpected continuation frame")
+			}
+		}
+		data = append(data, fr.payload...)
+		if !fr.fin {
+			continue
+		}
+
+		if compressed {
+			if data, err = inflate(data, conn.maxSize); err == errTooBig {
+				return 0, nil, &CloseError{Code: CloseMessageTooBig, Text: "Message too big"}
+			} else if err != nil {
+				return 0, nil, &CloseError{Code: CloseInvalidPayload, Text: "Invalid compressed data"}
+			}
+		}
+		if messageType == TextMessage && !utf8.Valid(data) {
+			return 0, nil, &CloseError{Code: CloseInvalidPayload, Text: "Invalid UTF-8"}
+		}
+		return messageType, data, nil
+	}
+}
+
+// Reads and checks one frame.  read is how much of the message has
+// already been read.
+func (conn *Conn) readFrame(read int64) (*frame, error) {
+	conn.setReadDeadline()
+	var head [14]byte
+	if _, err := io.ReadFull(conn.br, head[:2]); err != nil {
+		return nil, err
+	}
+	fr := &frame{
+		fin:  head[0]&0x80 != 0,
+		rsv1: head[0]&0x40 != 0,
+		op:   head[0] & 0xf,
+	}
+	control := fr.op&0x8 != 0
+	switch {
+	case head[0]&0x30 != 0:
+		return nil, protocolError("Reserved bits set")
+	case fr.rsv1 && (!conn.compress || control || fr.op == opContinuation):
+		return nil, protocolError("Unexpected compressed frame")
+	case fr.op > opBinary && !control, fr.op > opPong:
+		return nil, protocolError("Unknown opcode")
+	case head[1]&0x80 == 0:
+		return nil, protocolError("Client frames must be masked")
+	}
+
+	length := int64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		if _, err := io.ReadFull(conn.br, head[2:4]); err != nil {
+			return nil, err
+		}
+		length = int64(binary.BigEndian.Uint16(head[2:4]))
+	case 127:
+		if _, err := io.ReadFull(conn.br, head[2:10]); err != nil {
+			return nil, err
+		}
+		if head[2]&0x80 != 0 {
+			return nil, protocolError("Invalid frame length")
+		}
+		length = int64(binary.BigEndian.Uint64(head[2:10]))
+	}
+	if control && (length > 125 || !fr.fin) {
+		return nil, protocolError("Invalid control frame")
+	}
+	if !control && read+length > conn.maxSize {
+		return nil, &CloseError{Code: CloseMessageTooBig, Text: "Message too big"}
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(conn.br, mask[:]); err != nil {
+		return nil, err
+	}
+	fr.payload = make([]byte, length)
+	if _, err := io.ReadFull(conn.br, fr.payload); err != nil {
+		return nil, err
+	}
+	for i := range fr.payload {
+		fr.payload[i] ^= mask[i&3]
+	}
+	return fr, nil
+}
+
+func readCloseFrame(payload []byte) error {
+	switch {
+	case len(payload) == 0:
+		return &CloseError{Code: CloseNoStatusReceived}
+	case len(payload) == 1:
+		return protocolError("Invalid close frame")
+	}
+	code := int(binary.BigEndian.Uint16(payload))
+	text := payload[2:]
+	if !validCloseCode(code) {
+		return protocolError("Invalid close code")
+	}
+	if !utf8.Valid(text) {
+		return &CloseError{Code: CloseInvalidPayload, Text: "Invalid UTF-8"}
+	}
+	return &CloseError{Code: code, Text: string(text)}
+}
+
+// Codes a client may send
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// Sets the read deadline for the next frame.  Pings allow twice the ping
+// interval and a close waits for CloseTimeout.
+func (conn *Conn) setReadDeadline() {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	var deadline time.Time
+	if conn.pingInterval > 0 {
+		deadline = time.Now().Add(2 * conn.pingInterval)
+	}
+	if !conn.closeDeadline.IsZero() && (deadline.IsZero() || conn.closeDeadline.Before(deadline)) {
+		deadline = conn.closeDeadline
+	}
+	conn.c.SetReadDeadline(deadline)
+}
+
+// Writes a text or binary message
+func (conn *Conn) WriteMessage(messageType int, data []byte) error {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return errors.New("Invalid message type " + strconv.Itoa(messageType))
+	}
+	var compressed bool
+	if conn.compress && len(data) >= minCompressSize {
+		data = deflate(data)
+		compressed = true
+	}
+	conn.wmu.Lock()
+	defer conn.wmu.Unlock()
+	if conn.closeSent {
+		return ErrClosed
+	}
+	op := byte(messageType)
+	for {
+		n := len(data)
+		if conn.fragmentSize > 0 && n > conn.fragmentSize {
+			n = conn.fragmentSize
+		}
+		fin := n == len(data)
+		if err := conn.writeFrame(op, fin, compressed, data[:n]); err != nil {
+			return err
+		}
+		if fin {
+			return nil
+		}
+		data = data[n:]
+		op = opContinuation
+		// only the first frame is marked
+		compressed = false
+	}
+}
+
+// Sends a ping.  The client's pong is read by ReadMessage.
+func (conn *Conn) Ping(data []byte) error {
+	return conn.writeControl(opPing, data)
+}
+
+func (conn *Conn) writeControl(op byte, data []byte) error {
+	if len(data) > 125 {
+		return errors.New("Control frame payload too long")
+	}
+	conn.wmu.Lock()
+	defer conn.wmu.Unlock()
+	if conn.closeSent {
+		return ErrClosed
+	}
+	return conn.writeFrame(op, true, false, data)
+}
+
+// Must be called with wmu held
+func (conn *Conn) writeFrame(op byte, fin, rsv1 bool, payload []byte) error {
+	buf := make([]byte, 0, 10+len(payload))
+	b0 := op
+	if fin {
+		b0 |= 0x80
+	}
+	if rsv1 {
+		b0 |= 0x40
+	}
+	buf = append(buf, b0)
+	switch n := len(payload); {
+	case n <= 125:
+		buf = append(buf, byte(n))
+	case n <= 0xffff:
+		buf = append(buf, 126, byte(n>>8), byte(n))
+	default:
+		var length [8]byte
+		binary.BigEndian.PutUint64(length[:], uint64(n))
+		buf = append(buf, 127)
+		buf = append(buf, length[:]...)
+	}
+	buf = append(buf, payload...)
+	if conn.writeTimeout > 0 {
+		conn.c.SetWriteDeadline(time.Now().Add(conn.writeTimeout))
+	}
+	_, err := conn.c.Write(buf)
+	return err
+}
+
+// Sends a close frame unless one was already sent.  A zero code sends an
+// empty frame.  Reads after this give the client CloseTimeout to answer.
+func (conn *Conn) writeClose(code int, text string) (bool, error) {
+	conn.wmu.Lock()
+	defer conn.wmu.Unlock()
+	if conn.closeSent {
+		return false, nil
+	}
+	conn.closeSent = true
+	conn.mu.Lock()
+	conn.closeDeadline = time.Now().Add(conn.closeTimeout)
+	conn.mu.Unlock()
+
+	var payload []byte
+	if code != 0 {
+		if len(text) > 123 {
+			text = text[:123]
+		}
+		payload = make([]byte, 2, 2+len(text))
+		binary.BigEndian.PutUint16(payload, uint16(code))
+		payload = append(payload, text...)
+	}
+	return true, conn.writeFrame(opClose, true, false, payload)
+}
+
+// Starts the close handshake when the server is shutting down.  A
+// reader blocked in ReadMessage gets the client's answer.
+func (conn *Conn) goingAway() {
+	if sent, _ := conn.writeClose(CloseGoingAway, "Server shutting down"); sent {
+		conn.setReadDeadline()
+	}
+}
+
+// Closes the connection with the close handshake.  It waits up to
+// CloseTimeout for the client to answer, reading and dropping any
+// messages that arrive first, and then closes the network connection.
+func (conn *Conn) Close(code int, text string) error {
+	_, err := conn.writeClose(code, text)
+	// wakes up a reader in another goroutine sooner
+	conn.setReadDeadline()
+	conn.readMu.Lock()
+	for err == nil && conn.readErr == nil {
+		_, _, conn.readErr = conn.readMessage()
+	}
+	if !conn.closeReceived {
+		// the frames can't be trusted.  closing with unread data would
+		// reset the connection and the client could miss the close frame.
+		conn.setReadDeadline()
+		io.Copy(io.Discard, io.LimitReader(conn.br, conn.maxSize))
+	}
+	conn.readMu.Unlock()
+	if cerr := conn.c.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Pings the client until done is closed
+func (conn *Conn) pingLoop(interval time.Duration, done chan int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if conn.Ping(nil) != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,232 @@
+// Package websocket serves RFC 6455 WebSockets from a falcore pipeline.
+//
+// A Filter answers WebSocket handshakes and hands each connection to a
+// Handler as a message oriented Conn.  Ping, pong, fragmented messages,
+// the close handshake and the permessage-deflate extension (RFC 7692) are
+// taken care of.  Other requests pass through to the next stage.
+//
+//    ws := websocket.NewFilter(func(req *falcore.Request, conn *websocket.Conn) {
+//        for {
+//            typ, msg, err := conn.ReadMessage()
+//            if err != nil {
+//                return
+//            }
+//            conn.WriteMessage(typ, msg)
+//        }
+//    })
+//    pipeline.Upstream.PushBack(ws)
+//
+// When the server shuts down gracefully, each connection is sent a close
+// frame with CloseGoingAway.  The handler's next ReadMessage returns a
+// *CloseError once the client answers, and the server waits for the
+// handler to return.
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"github.com/ngmoco/falcore"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Called with each new connection.  The connection is closed when it
+// returns.
+type Handler func(req *falcore.Request, conn *Conn)
+
+// A falcore.RequestFilter that accepts WebSocket connections
+type Filter struct {
+	Handler Handler
+	// Subprotocols the server speaks in order of preference.  The first
+	// one the client also asked for is chosen.  See Conn.Subprotocol.
+	Protocols []string
+	// Decides whether to accept a request with an Origin header.  The
+	// default only accepts an Origin with the same host as the request.
+	CheckOrigin func(req *falcore.Request) bool
+	// Negotiate permessage-deflate with clients that offer it
+	EnableCompression bool
+	// Largest message accepted from the client.  Larger messages close
+	// the connection with CloseMessageTooBig.  Defaults to 1MB.
+	MaxMessageSize int64
+	// Messages written are split into frames of at most this many bytes.
+	// Zero sends each message in one frame.
+	FragmentSize int
+	// Sends a ping this often and closes the connection if nothing is
+	// heard from the client for twice as long.  Zero disables pings.
+	PingInterval time.Duration
+	// Limit on each write to the client.  Zero means no limit.
+	WriteTimeout time.Duration
+	// How long to wait for the client to answer a close frame.  Defaults
+	// to 5 seconds.
+	CloseTimeout time.Duration
+}
+
+func NewFilter(handler Handler) *Filter {
+	f := new(Filter)
+	f.Handler = handler
+	f.MaxMessageSize = 1 << 20
+	f.CloseTimeout = 5 * time.Second
+	return f
+}
+
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Reports whether the request asks for a WebSocket upgrade
+func IsWebSocketRequest(req *falcore.Request) bool {
+	h := req.HttpRequest.Header
+	return req.HttpRequest.Method == "GET" &&
+		headerHasToken(h, "Connection", "upgrade") &&
+		headerHasToken(h, "Upgrade", "websocket")
+}
+
+// Answers the handshake.  Requests that aren't WebSocket upgrades return
+// nil so the pipeline continues.
+func (f *Filter) FilterRequest(req *falcore.Request) *http.Response {
+	if !IsWebSocketRequest(req) {
+		return nil
+	}
+	h := req.HttpRequest.Header
+	if h.Get("Sec-WebSocket-Version") != "13" {
+		header := make(http.Header)
+		header.Set("Sec-WebSocket-Version", "13")
+		return falcore.SimpleResponse(req.HttpRequest, 426, header, "Unsupported WebSocket version\n")
+	}
+	key := h.Get("Sec-WebSocket-Key")
+	if b, err := base64.StdEncoding.DecodeString(key); err != nil || len(b) != 16 {
+		return falcore.SimpleResponse(req.HttpRequest, 400, nil, "Invalid Sec-WebSocket-Key\n")
+	}
+	checkOrigin := f.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = sameOrigin
+	}
+	if !checkOrigin(req) {
+		return falcore.SimpleResponse(req.HttpRequest, 403, nil, "Origin not allowed\n")
+	}
+
+	protocol := f.chooseProtocol(h)
+	var compress bool
+	if f.EnableCompression {
+		compress = acceptDeflate(h)
+	}
+	res := falcore.NewUpgradeResponse(req, "websocket", func(c net.Conn, br *bufio.Reader) {
+		conn := newConn(c, br, f, protocol, compress)
+		f.serve(req, conn)
+	})
+	res.Header.Set("Sec-WebSocket-Accept", acceptKey(key))
+	if protocol != "" {
+		res.Header.Set("Sec-WebSocket-Protocol", protocol)
+	}
+	if compress {
+		res.Header.Set("Sec-WebSocket-Extensions", "permessage-deflate; server_no_context_takeover; client_no_context_takeover")
+	}
+	return res
+}
+
+// Runs the handler and closes the connection properly around it
+func (f *Filter) serve(req *falcore.Request, conn *Conn) {
+	done := make(chan int)
+	defer close(done)
+	go func() {
+		select {
+		case <-req.Stopping():
+			conn.goingAway()
+		case <-done:
+		}
+	}()
+	if f.PingInterval > 0 {
+		go conn.pingLoop(f.PingInterval, done)
+	}
+	f.Handler(req, conn)
+	conn.Close(CloseNormalClosure, "")
+}
+
+func (f *Filter) chooseProtocol(h http.Header) string {
+	offered := headerTokens(h, "Sec-WebSocket-Protocol")
+	for _, p := range f.Protocols {
+		for _, o := range offered {
+			if p == o {
+				return p
+			}
+		}
+	}
+	return ""
+}
+
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Browsers send Origin with every WebSocket request.  Other clients
+// usually don't.
+func sameOrigin(req *falcore.Request) bool {
+	origin := req.HttpRequest.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, req.HttpRequest.Host)
+}
+
+// Looks for a permessage-deflate offer the server can accept.  Go's flate
+// always uses a 32K window so offers that limit the server's window are
+// declined.  The context is never kept between messages so both sides
+// use no_context_takeover.
+func acceptDeflate(h http.Header) bool {
+	for _, offer := range headerTokens(h, "Sec-WebSocket-Extensions") {
+		params := strings.Split(offer, ";")
+		if strings.TrimSpace(params[0]) != "permessage-deflate" {
+			continue
+		}
+		ok := true
+		for _, p := range params[1:] {
+			name, value := strings.TrimSpace(p), ""
+			if i := strings.Index(name, "="); i >= 0 {
+				name, value = strings.TrimSpace(name[:i]), strings.Trim(strings.TrimSpace(name[i+1:]), `"`)
+			}
+			switch name {
+			case "server_no_context_takeover", "client_no_context_takeover", "client_max_window_bits":
+			case "server_max_window_bits":
+				if bits, err := strconv.Atoi(value); err != nil || bits != 15 {
+					ok = false
+				}
+			default:
+				ok = false
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// The comma separated values of a header
+func headerTokens(h http.Header, name string) []string {
+	var tokens []string
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				tokens = append(tokens, t)
+			}
+		}
+	}
+	return tokens
+}
+
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, t := range headerTokens(h, name) {
+		if strings.EqualFold(t, token) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,318 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/ngmoco/falcore"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startServer(t *testing.T, f *Filter) *falcore.Server {
+	p := falcore.NewPipeline()
+	p.Upstream.PushBack(f)
+	p.Upstream.PushBack(falcore.NewRequestFilter(func(req *falcore.Request) *http.Response {
+		return falcore.SimpleResponse(req.HttpRequest, 200, nil, "OK")
+	}))
+	srv := falcore.NewServer(0, p)
+	go srv.ListenAndServe()
+	<-srv.AcceptReady
+	return srv
+}
+
+func echoHandler(req *falcore.Request, conn *Conn) {
+	for {
+		typ, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		conn.WriteMessage(typ, msg)
+	}
+}
+
+// A minimal client
+type testClient struct {
+	c  net.Conn
+	br *bufio.Reader
+}
+
+func dial(t *testing.T, srv *falcore.Server, header string) (*testClient, *http.Response) {
+	c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", srv.Port()))
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(c, "GET /ws HTTP/1.1\r\nHost: test\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n%s\r\n", header)
+	br := bufio.NewReader(c)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("Could not read handshake: %v", err)
+	}
+	return &testClient{c, br}, res
+}
+
+func (tc *testClient) writeFrame(b0 byte, payload []byte) {
+	mask := []byte{1, 2, 3, 4}
+	buf := []byte{b0}
+	switch n := len(payload); {
+	case n <= 125:
+		buf = append(buf, 0x80|byte(n))
+	case n <= 0xffff:
+		buf = append(buf, 0x80|126, byte(n>>8), byte(n))
+	default:
+		var length [8]byte
+		binary.BigEndian.PutUint64(length[:], uint64(n))
+		buf = append(append(buf, 0x80|127), length[:]...)
+	}
+	buf = append(buf, mask...)
+	for i, b := range payload {
+		buf = append(buf, b^mask[i&3])
+	}
+	tc.c.Write(buf)
+}
+
+func (tc *testClient) readFrame(t *testing.T) (byte, []byte) {
+	var head [2]byte
+	if _, err := io.ReadFull(tc.br, head[:]); err != nil {
+		t.Fatalf("Could not read frame: %v", err)
+	}
+	if head[1]&0x80 != 0 {
+		t.Fatalf("Server frame was masked")
+	}
+	length := int(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(tc.br, ext[:])
+		length = int(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		io.ReadFull(tc.br, ext[:])
+		length = int(binary.BigEndian.Uint64(ext[:]))
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(tc.br, payload); err != nil {
+		t.Fatalf("Could not read payload: %v", err)
+	}
+	return head[0], payload
+}
+
+func closePayload(code int, text string) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, uint16(code))
+	return append(b, text...)
+}
+
+func TestHandshake(t *testing.T) {
+	f := NewFilter(echoHandler)
+	f.Protocols = []string{"chat", "superchat"}
+	srv := startServer(t, f)
+	defer srv.Shutdown(context.Background())
+
+	tc, res := dial(t, srv, "Sec-WebSocket-Protocol: superchat, chat\r\n")
+	defer tc.c.Close()
+	if res.StatusCode != 101 {
+		t.Fatalf("Got %v expected 101", res.StatusCode)
+	}
+	// the example from RFC 6455
+	if accept := res.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Sec-WebSocket-Accept %q", accept)
+	}
+	if p := res.Header.Get("Sec-WebSocket-Protocol"); p != "chat" {
+		t.Errorf("Protocol %q expected chat", p)
+	}
+	if ext := res.Header.Get("Sec-WebSocket-Extensions"); ext != "" {
+		t.Errorf("Extensions %q without compression", ext)
+	}
+
+	// other requests pass through
+	c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", srv.Port()))
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer c.Close()
+	io.WriteString(c, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+	if res, err := http.ReadResponse(bufio.NewReader(c), nil); err != nil || res.StatusCode != 200 {
+		t.Errorf("Plain request got %v %v", res, err)
+	}
+
+	tests := []struct {
+		header string
+		status int
+	}{
+		{"Origin: http://evil.example\r\n", 403},
+		{"Origin: http://test\r\n", 101},
+	}
+	for _, test := range tests {
+		tc, res := dial(t, srv, test.header)
+		tc.c.Close()
+		if res.StatusCode != test.status {
+			t.Errorf("%q got %v expected %v", test.header, res.StatusCode, test.status)
+		}
+	}
+}
+
+func TestMessages(t *testing.T) {
+	srv := startServer(t, NewFilter(echoHandler))
+	defer srv.Shutdown(context.Background())
+	tc, _ := dial(t, srv, "")
+	defer tc.c.Close()
+
+	tc.writeFrame(0x81, []byte("hello"))
+	if op, msg := tc.readFrame(t); op != 0x81 || string(msg) != "hello" {
+		t.Errorf("Got %x %q expected hello", op, msg)
+	}
+
+	// a ping in the middle of a fragmented message
+	big := bytes.Repeat([]byte("x"), 70000)
+	tc.writeFrame(0x02, big[:100])
+	tc.writeFrame(0x89, []byte("ping"))
+	tc.writeFrame(0x00, big[100:60000])
+	tc.writeFrame(0x80, big[60000:])
+	if op, msg := tc.readFrame(t); op != 0x8a || string(msg) != "ping" {
+		t.Errorf("Got %x %q expected a pong", op, msg)
+	}
+	if op, msg := tc.readFrame(t); op != 0x82 || !bytes.Equal(msg, big) {
+		t.Errorf("Got %x with %v bytes expected the message back", op, len(msg))
+	}
+
+	// close handshake
+	tc.writeFrame(0x88, closePayload(CloseNormalClosure, "bye"))
+	if op, msg := tc.readFrame(t); op != 0x88 || !bytes.Equal(msg, closePayload(CloseNormalClosure, "bye")) {
+		t.Errorf("Got %x %q expected the close echoed", op, msg)
+	}
+	if _, err := tc.br.ReadByte(); err != io.EOF {
+		t.Errorf("Connection wasn't closed: %v", err)
+	}
+}
+
+func TestProtocolErrors(t *testing.T) {
+	srv := startServer(t, NewFilter(echoHandler))
+	defer srv.Shutdown(context.Background())
+
+	tests := []struct {
+		name string
+		send func(tc *testClient)
+		code int
+	}{
+		{"unmasked", func(tc *testClient) { tc.c.Write([]byte{0x81, 0x01, 'x'}) }, CloseProtocolError},
+		{"invalid utf-8", func(tc *testClient) { tc.writeFrame(0x81, []byte{0xff}) }, CloseInvalidPayload},
+		{"stray continuation", func(tc *testClient) { tc.writeFrame(0x80, []byte("x")) }, CloseProtocolError},
+		{"compressed", func(tc *testClient) { tc.writeFrame(0xc1, []byte("x")) }, CloseProtocolError},
+		{"too big", func(tc *testClient) { tc.writeFrame(0x82, make([]byte, 1<<20+1)) }, CloseMessageTooBig},
+	}
+	for _, test := range tests {
+		tc, _ := dial(t, srv, "")
+		test.send(tc)
+		op, msg := tc.readFrame(t)
+		if op != 0x88 || len(msg) < 2 || int(binary.BigEndian.Uint16(msg)) != test.code {
+			t.Errorf("%s got %x %q expected close %v", test.name, op, msg, test.code)
+		}
+		tc.c.Close()
+	}
+}
+
+func TestCompression(t *testing.T) {
+	f := NewFilter(echoHandler)
+	f.EnableCompression = true
+	srv := startServer(t, f)
+	defer srv.Shutdown(context.Background())
+
+	tc, res := dial(t, srv, "Sec-WebSocket-Extensions: permessage-deflate; client_max_window_bits\r\n")
+	defer tc.c.Close()
+	if ext := res.Header.Get("Sec-WebSocket-Extensions"); !strings.HasPrefix(ext, "permessage-deflate") {
+		t.Fatalf("Extensions %q expected permessage-deflate", ext)
+	}
+
+	msg := strings.Repeat("compress me ", 100)
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.BestSpeed)
+	io.WriteString(w, msg)
+	w.Flush()
+	tc.writeFrame(0xc1, bytes.TrimSuffix(buf.Bytes(), []byte{0, 0, 0xff, 0xff}))
+
+	op, payload := tc.readFrame(t)
+	if op != 0xc1 {
+		t.Fatalf("Got %x expected a compressed text frame", op)
+	}
+	if len(payload) >= len(msg) {
+		t.Errorf("Compressed to %v bytes from %v", len(payload), len(msg))
+	}
+	r := flate.NewReader(io.MultiReader(bytes.NewReader(payload), bytes.NewReader(deflateTail)))
+	if b, err := io.ReadAll(r); err != nil || string(b) != msg {
+		t.Errorf("Got %q %v expected the message back", b, err)
+	}
+
+	// the server's window can't be limited
+	tc2, res := dial(t, srv, "Sec-WebSocket-Extensions: permessage-deflate; server_max_window_bits=10\r\n")
+	tc2.c.Close()
+	if ext := res.Header.Get("Sec-WebSocket-Extensions"); ext != "" {
+		t.Errorf("Extensions %q expected none", ext)
+	}
+}
+
+func TestFragmentedWrite(t *testing.T) {
+	f := NewFilter(func(req *falcore.Request, conn *Conn) {
+		conn.WriteMessage(TextMessage, []byte("hello world"))
+		conn.ReadMessage()
+	})
+	f.FragmentSize = 5
+	srv := startServer(t, f)
+	defer srv.Shutdown(context.Background())
+	tc, _ := dial(t, srv, "")
+	defer tc.c.Close()
+
+	expected := []struct {
+		op  byte
+		msg string
+	}{{0x01, "hello"}, {0x00, " worl"}, {0x80, "d"}}
+	for _, e := range expected {
+		if op, msg := tc.readFrame(t); op != e.op || string(msg) != e.msg {
+			t.Errorf("Got %x %q expected %x %q", op, msg, e.op, e.msg)
+		}
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	closed := make(chan error, 1)
+	srv := startServer(t, NewFilter(func(req *falcore.Request, conn *Conn) {
+		_, _, err := conn.ReadMessage()
+		closed <- err
+	}))
+	tc, _ := dial(t, srv, "")
+	defer tc.c.Close()
+
+	done := make(chan error, 1)
+	go func() { done <- srv.Shutdown(context.Background()) }()
+	op, msg := tc.readFrame(t)
+	if op != 0x88 || int(binary.BigEndian.Uint16(msg)) != CloseGoingAway {
+		t.Fatalf("Got %x %q expected close going away", op, msg)
+	}
+	// the handler keeps the server up until the client answers
+	select {
+	case <-done:
+		t.Fatalf("Shutdown finished before the close handshake")
+	case <-time.After(100 * time.Millisecond):
+	}
+	tc.writeFrame(0x88, msg)
+	if err, ok := (<-closed).(*CloseError); !ok || err.Code != CloseGoingAway {
+		t.Errorf("ReadMessage returned %v expected a close error", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Shutdown error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Shutdown didn't finish")
+	}
+}